@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/sralloza/rpi-provisioner/pkg/fail2ban"
+)
+
+func NewBansCmd() *cobra.Command {
+	args := fail2ban.BansArgs{}
+	var bansCmd = &cobra.Command{
+		Use:   "bans",
+		Short: "List and unban the IPs banned by fail2ban",
+		Long: `Show the failed logins and the IPs banned by the sshd jail of fail2ban (configured by
+layer2). Use --unban to remove the ban of some IPs.`,
+		PreRunE: func(cmd *cobra.Command, posArgs []string) error {
+			if len(args.KeyPath) > 0 {
+				args.UseSSHKey = true
+			}
+			if !args.UseSSHKey && len(args.Password) == 0 {
+				return errors.New("must pass --ssh-key or --password")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			status, err := fail2ban.Bans(args)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("\nJail %s\n", status.Jail)
+			fmt.Printf("  Failed: %d (total %d)\n", status.CurrentlyFailed, status.TotalFailed)
+			fmt.Printf("  Banned: %d (total %d)\n", status.CurrentlyBanned, status.TotalBanned)
+			if len(status.BannedIPs) > 0 {
+				fmt.Printf("  Banned IPs: %s\n", strings.Join(status.BannedIPs, ", "))
+			}
+			return nil
+		},
+	}
+
+	bansCmd.Flags().BoolVar(&args.UseSSHKey, "ssh-key", false, "Use ssh key")
+	bansCmd.Flags().StringVar(&args.KeyPath, "identity", "", "Private ssh key (implies --ssh-key, default ~/.ssh/id_rsa)")
+	bansCmd.Flags().StringVar(&args.User, "user", "", "Login user")
+	bansCmd.Flags().StringVar(&args.Password, "password", "", "Login password")
+	bansCmd.Flags().StringVar(&args.Host, "host", "", "Server host")
+	bansCmd.Flags().IntVar(&args.Port, "port", 22, "Server SSH port")
+	bansCmd.Flags().StringSliceVar(&args.Unban, "unban", nil, "IPs to unban")
+
+	bansCmd.MarkFlagRequired("user")
+	bansCmd.MarkFlagRequired("host")
+
+	return bansCmd
+}
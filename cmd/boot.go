@@ -2,73 +2,375 @@ package cmd
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/sralloza/rpi-provisioner/pkg/boot"
+	"github.com/sralloza/rpi-provisioner/pkg/state"
 )
 
-type BootArgs struct {
-	hostname string
-	wifiCountry  string
-	wifiSSID string
-	wifiPass string
-}
-
 func NewBootCmd() *cobra.Command {
-	args := BootArgs{}
+	flags := bootFlags{}
 	var bootCmd = &cobra.Command{
 		Use:   "boot [BOOT_PATH]",
 		Short: "Setup image before first boot",
-		Long:  `Enable ssh, setup wifi connection and create default user (pi) the firstrun.sh script`,
-		Args: func(cmd *cobra.Command, posArgs []string) error {
-			if len(posArgs) != 1 {
-				return fmt.Errorf("BOOT_PATH is required")
-			}
-			bootPath := posArgs[0]
-			if !isDirectory(bootPath) {
-				return fmt.Errorf("'%s' is not a directory", bootPath)
+		Long: `Enable ssh, setup wifi connection and create default user (pi) the firstrun.sh script.
+If the image uses cloud-init (user-data and network-config in the boot partition), the
+same settings are written as cloud-init configuration instead.
+
+If BOOT_PATH is not passed, the mounted boot partition is detected automatically.`,
+		Args: bootPathArgs,
+		PreRunE: func(cmd *cobra.Command, posArgs []string) error {
+			if !flags.hasHostname() {
+				return fmt.Errorf("must pass --hostname or --hostname-pattern")
 			}
+			return flags.validate(cmd)
+		},
 
-			cmdLinePath := filepath.Join(bootPath, "cmdline.txt")
-			_, err := os.Stat(cmdLinePath)
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			bootPath, err := resolveBootPath(posArgs)
 			if err != nil {
-				return fmt.Errorf("cmdline.txt ('%s') does not exist", cmdLinePath)
+				return err
 			}
-			return nil
+			err = flags.resolveHostname()
+			if err != nil {
+				return err
+			}
+			flags.args.BootPath = bootPath
+			err = boot.NewBootManager().Setup(flags.args)
+			if err != nil {
+				return err
+			}
+			if flags.args.SerialConsole {
+				fmt.Printf("\n%s\n", boot.SerialConsoleWiring)
+			}
+			return flags.record()
 		},
-		PreRunE: func(cmd *cobra.Command, posArgs []string) error {
-			if len(args.wifiPass) == 0 && len(args.wifiSSID) != 0 {
-				return fmt.Errorf("you passed --wifi-ssid, you need to specify --wifi-pass")
+	}
+
+	flags.register(bootCmd)
+
+	bootCmd.AddCommand(NewBootInspectCmd())
+	bootCmd.AddCommand(NewBootRevertCmd())
+
+	return bootCmd
+}
+
+// bootFlags are the flags of the boot command, shared with the commands that
+// run the boot setup after other tasks
+type bootFlags struct {
+	args            boot.BootArgs
+	staticIP        boot.StaticIP
+	ipAddress       string
+	usbGadgetIP     string
+	hostnamePattern string
+	start           int
+	mac             string
+	manifest        string
+
+	// Loaded when the hostname is generated from hostnamePattern
+	state         *state.State
+	hostnameIndex int
+}
+
+func (f *bootFlags) register(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&f.args.Hostname, "hostname", "", "Hostname")
+	cmd.Flags().StringVar(&f.hostnamePattern, "hostname-pattern", "", "Generate the hostname from a pattern with a sequence number (e.g. node-%02d)")
+	cmd.Flags().IntVar(&f.start, "start", 0, "Sequence number used with --hostname-pattern (defaults to the one after the last used)")
+	cmd.Flags().StringVar(&f.mac, "mac", "", "Expected MAC address of the raspberry, saved in the manifest")
+	cmd.Flags().StringVar(&f.manifest, "manifest", "", "Manifest where the prepared raspberries are saved (defaults to manifest.json in the config directory)")
+	cmd.Flags().StringVar(&f.args.WifiCountry, "wifi-country", "ES", "WiFi country code (2 digits)")
+	cmd.Flags().StringVar(&f.args.WifiSSID, "wifi-ssid", "", "WiFi SSID")
+	cmd.Flags().StringVar(&f.args.WifiPass, "wifi-pass", "", "WiFi password")
+	cmd.Flags().StringVar(&f.args.Timezone, "timezone", "", "Timezone (e.g. Europe/Madrid)")
+	cmd.Flags().StringVar(&f.args.Locale, "locale", "", "Locale (e.g. es_ES.UTF-8)")
+	cmd.Flags().StringVar(&f.args.Keymap, "keymap", "", "Keyboard layout (e.g. es)")
+	cmd.Flags().StringVar(&f.args.KeysUri, "keys-uri", "", "Authorized keys for the default user. Can be a AWS S3 URI, HTTP(S) or a file path.")
+
+	cmd.Flags().StringVar(&f.ipAddress, "ip", "", "Static IP in CIDR notation (e.g. 192.168.1.50/24). The mask defaults to /24")
+	cmd.Flags().StringVar(&f.staticIP.Interface, "ip-interface", "eth0", "Interface with the static IP (eth0 or wlan0)")
+	cmd.Flags().IPVar(&f.staticIP.Gateway, "gateway", nil, "Gateway of the static IP (defaults to the first address of the subnet)")
+	cmd.Flags().IPSliceVar(&f.staticIP.DNS, "dns", []net.IP{net.ParseIP("1.1.1.1")}, "DNS servers of the static IP")
+
+	cmd.Flags().BoolVar(&f.args.UsbGadget, "usb-gadget", false, "Enable USB gadget mode (ethernet over USB, for Pi Zero boards)")
+	cmd.Flags().StringVar(&f.usbGadgetIP, "usb-gadget-ip", boot.DefaultUsbGadgetIP.String(), "Static IP of the usb0 interface in CIDR notation")
+	cmd.Flags().BoolVar(&f.args.SerialConsole, "serial-console", false, "Enable the UART and a login console on it (GPIO14/GPIO15, 115200 baud)")
+	cmd.Flags().StringArrayVar(&f.args.Hooks, "hook", nil, "Script executed at the end of the first boot. It can be repeated, hooks are executed in order")
+	cmd.Flags().StringVar(&f.args.Template, "template", "", "Template that replaces the embedded firstrun.sh template")
+	cmd.Flags().BoolVar(&f.args.HostKeys, "host-keys", false, "Generate the ssh host keys and add them to ~/.ssh/known_hosts")
+	addHardwareFlags(cmd, &f.args.Hardware)
+}
+
+func (f *bootFlags) validate(cmd *cobra.Command) error {
+	args := &f.args
+	if len(args.Hostname) != 0 && len(f.hostnamePattern) != 0 {
+		return fmt.Errorf("--hostname and --hostname-pattern can't be used together")
+	}
+	if len(f.hostnamePattern) != 0 {
+		if err := state.ValidateHostnamePattern(f.hostnamePattern); err != nil {
+			return err
+		}
+	}
+	if cmd.Flags().Changed("start") {
+		if len(f.hostnamePattern) == 0 {
+			return fmt.Errorf("you passed --start, you need to specify --hostname-pattern")
+		}
+		if f.start <= 0 {
+			return fmt.Errorf("invalid start: %d, it must be positive", f.start)
+		}
+	}
+	if len(f.mac) != 0 {
+		mac, err := net.ParseMAC(f.mac)
+		if err != nil {
+			return fmt.Errorf("invalid MAC address '%s': %w", f.mac, err)
+		}
+		f.mac = mac.String()
+	}
+	if len(args.WifiPass) == 0 && len(args.WifiSSID) != 0 {
+		return fmt.Errorf("you passed --wifi-ssid, you need to specify --wifi-pass")
+	}
+	if len(args.WifiPass) != 0 && len(args.WifiSSID) == 0 {
+		return fmt.Errorf("you passed --wifi-pass, you need to specify --wifi-ssid")
+	}
+	for _, path := range append(append([]string{}, args.Hooks...), args.Template) {
+		if len(path) == 0 {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			return fmt.Errorf("'%s' does not exist", path)
+		}
+	}
+	if err := args.Hardware.Validate(); err != nil {
+		return err
+	}
+	if cmd.Flags().Changed("usb-gadget-ip") && !args.UsbGadget {
+		return fmt.Errorf("you passed --usb-gadget-ip, you need to specify --usb-gadget")
+	}
+	if args.UsbGadget {
+		address, err := parseStaticIP(f.usbGadgetIP)
+		if err != nil {
+			return err
+		}
+		args.UsbGadgetIP = address
+	}
+	if len(f.ipAddress) == 0 {
+		for _, flag := range []string{"gateway", "dns", "ip-interface"} {
+			if cmd.Flags().Changed(flag) {
+				return fmt.Errorf("you passed --%s, you need to specify --ip", flag)
 			}
-			if len(args.wifiPass) != 0 && len(args.wifiSSID) == 0 {
-				return fmt.Errorf("you passed --wifi-pass, you need to specify --wifi-ssid")
+		}
+		return nil
+	}
+	switch f.staticIP.Interface {
+	case "eth0":
+	case "wlan0":
+		if len(args.WifiSSID) == 0 {
+			return fmt.Errorf("you passed --ip-interface wlan0, you need to specify --wifi-ssid")
+		}
+	default:
+		return fmt.Errorf("invalid --ip-interface '%s', it must be eth0 or wlan0", f.staticIP.Interface)
+	}
+
+	address, err := parseStaticIP(f.ipAddress)
+	if err != nil {
+		return err
+	}
+	f.staticIP.Address = address
+	if f.staticIP.Gateway == nil {
+		f.staticIP.Gateway = firstHost(address)
+	}
+	args.StaticIP = &f.staticIP
+	return nil
+}
+
+func (f *bootFlags) hasHostname() bool {
+	return len(f.args.Hostname) != 0 || len(f.hostnamePattern) != 0
+}
+
+// resolveHostname generates the hostname if --hostname-pattern was passed
+func (f *bootFlags) resolveHostname() error {
+	if len(f.hostnamePattern) == 0 {
+		return nil
+	}
+
+	current, err := state.Load()
+	if err != nil {
+		return err
+	}
+	f.state = current
+	f.args.Hostname, f.hostnameIndex = current.NextHostname(f.hostnamePattern, f.start)
+	fmt.Printf("Using hostname %s\n\n", f.args.Hostname)
+	return nil
+}
+
+// record saves the last index of the hostname pattern and adds the raspberry
+// to the manifest. It must be called after the boot setup succeeds.
+func (f *bootFlags) record() error {
+	if f.state != nil {
+		f.state.HostnameIndexes[f.hostnamePattern] = f.hostnameIndex
+		if err := f.state.Save(); err != nil {
+			return err
+		}
+	}
+
+	manifestPath := f.manifest
+	if len(manifestPath) == 0 {
+		defaultPath, err := state.ManifestPath()
+		if err != nil {
+			return err
+		}
+		manifestPath = defaultPath
+	}
+
+	entry := state.ManifestEntry{
+		Hostname:  f.args.Hostname,
+		MAC:       f.mac,
+		CreatedAt: time.Now(),
+	}
+	if f.args.StaticIP != nil {
+		entry.IP = f.args.StaticIP.Address.IP.String()
+	}
+	err := state.AddToManifest(manifestPath, entry)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("\nAdded %s to the manifest %s\n", entry.Hostname, manifestPath)
+	return nil
+}
+
+func NewBootInspectCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "inspect [BOOT_PATH]",
+		Short: "Show the configuration of the boot partition",
+		Long:  `Show if ssh is enabled and the hostname, user, WiFi networks and systemd.run args found in the boot partition.`,
+		Args:  bootPathArgs,
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			bootPath, err := resolveBootPath(posArgs)
+			if err != nil {
+				return err
+			}
+			result, err := boot.NewBootManager().Inspect(bootPath)
+			if err != nil {
+				return err
+			}
+
+			provisioning := "none"
+			if result.CloudInit {
+				provisioning = "cloud-init"
+			} else if result.FirstRun {
+				provisioning = "firstrun.sh"
 			}
+
+			fmt.Printf("Boot partition: %s\n", bootPath)
+			fmt.Printf("  Provisioning: %s\n", provisioning)
+			fmt.Printf("  SSH enabled: %s\n", yesNo(result.SSHEnabled))
+			fmt.Printf("  Hostname: %s\n", valueOrDash(result.Hostname))
+			fmt.Printf("  User: %s\n", valueOrDash(result.User))
+			fmt.Printf("  WiFi networks: %s\n", valueOrDash(strings.Join(result.WifiNetworks, ", ")))
+			fmt.Printf("  systemd args: %s\n", valueOrDash(strings.Join(result.SystemdArgs, " ")))
+			fmt.Printf("  Backup: %s\n", yesNo(result.HasBackup))
 			return nil
 		},
+	}
+}
 
+func NewBootRevertCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "revert [BOOT_PATH]",
+		Short: "Revert the changes made by the boot command",
+		Long:  `Restore the original cmdline.txt (from the backup written the first time the boot command was executed) and remove firstrun.sh and ssh.`,
+		Args:  bootPathArgs,
 		RunE: func(cmd *cobra.Command, posArgs []string) error {
-			bm := boot.NewBootManager()
-			return bm.Setup(posArgs[0], args.hostname, args.wifiCountry, args.wifiSSID, args.wifiPass)
+			bootPath, err := resolveBootPath(posArgs)
+			if err != nil {
+				return err
+			}
+			return boot.NewBootManager().Revert(bootPath)
 		},
 	}
+}
+
+func bootPathArgs(cmd *cobra.Command, posArgs []string) error {
+	if len(posArgs) > 1 {
+		return fmt.Errorf("only one BOOT_PATH is allowed")
+	}
+	if len(posArgs) == 0 {
+		return nil
+	}
+	bootPath := posArgs[0]
+	if !boot.IsDirectory(bootPath) {
+		return fmt.Errorf("'%s' is not a directory", bootPath)
+	}
 
-	bootCmd.Flags().StringVar(&args.hostname, "hostname", "", "Hostname")
-	bootCmd.Flags().StringVar(&args.wifiCountry, "wifi-country", "ES", "WiFi country code (2 digits)")
-	bootCmd.Flags().StringVar(&args.wifiSSID, "wifi-ssid", "", "WiFi SSID")
-	bootCmd.Flags().StringVar(&args.wifiPass, "wifi-pass", "", "WiFi password")
+	cmdLinePath := filepath.Join(bootPath, "cmdline.txt")
+	_, err := os.Stat(cmdLinePath)
+	if err != nil {
+		return fmt.Errorf("cmdline.txt ('%s') does not exist", cmdLinePath)
+	}
+	return nil
+}
 
-	bootCmd.MarkFlagRequired("hostname")
+// resolveBootPath returns BOOT_PATH if it was passed, otherwise it looks for
+// the mounted boot partition
+func resolveBootPath(posArgs []string) (string, error) {
+	if len(posArgs) == 1 {
+		return posArgs[0], nil
+	}
 
-	return bootCmd
+	partitions, err := boot.FindBootPartitions()
+	if err != nil {
+		return "", err
+	}
+	if len(partitions) == 0 {
+		return "", fmt.Errorf("boot partition not found, make sure the SD card is mounted or pass BOOT_PATH")
+	}
+	if len(partitions) > 1 {
+		candidates := []string{}
+		for _, partition := range partitions {
+			candidates = append(candidates, "  "+partition.String())
+		}
+		return "", fmt.Errorf("found %d boot partitions, pass BOOT_PATH to choose one:\n%s",
+			len(partitions), strings.Join(candidates, "\n"))
+	}
+
+	fmt.Printf("Using boot partition %s\n\n", partitions[0])
+	return partitions[0].Path, nil
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
 }
 
-func isDirectory(path string) bool {
-	fileInfo, err := os.Stat(path)
+func valueOrDash(value string) string {
+	if len(value) == 0 {
+		return "-"
+	}
+	return value
+}
+
+func parseStaticIP(address string) (*net.IPNet, error) {
+	if !strings.Contains(address, "/") {
+		address += "/24"
+	}
+	ip, network, err := net.ParseCIDR(address)
 	if err != nil {
-		return false
+		return nil, fmt.Errorf("invalid static IP '%s': %w", address, err)
+	}
+	if ip.To4() == nil {
+		return nil, fmt.Errorf("invalid static IP '%s': only IPv4 is supported", address)
 	}
+	return &net.IPNet{IP: ip.To4(), Mask: network.Mask}, nil
+}
 
-	return fileInfo.IsDir()
+func firstHost(address *net.IPNet) net.IP {
+	gateway := address.IP.Mask(address.Mask)
+	gateway[len(gateway)-1]++
+	return gateway
 }
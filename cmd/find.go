@@ -5,18 +5,28 @@ import (
 
 	"github.com/spf13/cobra"
 	"github.com/sralloza/rpi-provisioner/pkg/find"
+	"github.com/sralloza/rpi-provisioner/pkg/state"
 )
 
 func NewFindCommand() *cobra.Command {
 	args := find.Args{}
+	useManifest := false
 	var findCmd = &cobra.Command{
 		Use:   "find",
 		Short: "Find your raspberry pi in your local network",
 		Long:  `Find your raspberry pi in your local network using SSH.`,
+		Args:  cobra.NoArgs,
 		RunE: func(cmd *cobra.Command, posArgs []string) error {
 			if !args.UseSSHKey && len(args.Password) == 0 {
 				return fmt.Errorf("must pass --ssh-key or --password")
 			}
+			if useManifest && len(args.Manifest) == 0 {
+				manifestPath, err := state.ManifestPath()
+				if err != nil {
+					return err
+				}
+				args.Manifest = manifestPath
+			}
 			if err := find.NewFinder().Run(args); err != nil {
 				return err
 			}
@@ -24,9 +34,12 @@ func NewFindCommand() *cobra.Command {
 		},
 	}
 	findCmd.Flags().StringVar(&args.Subnet, "subnet", "", "Subnet to find the raspberry")
+	findCmd.Flags().StringVar(&args.Interface, "iface", "", "Network interface to scan (e.g. usb0), its subnet is used if --subnet is not passed")
 	findCmd.Flags().StringVar(&args.User, "user", "pi", "User to login via ssh")
 	findCmd.Flags().StringVar(&args.Password, "password", "raspberry", "Password to login via ssh")
 	findCmd.Flags().BoolVar(&args.UseSSHKey, "ssh-key", false, "Use SSH key to login instead of password")
 	findCmd.Flags().IntVar(&args.Port, "port", 22, "Port to connect via ssh")
+	findCmd.Flags().BoolVar(&useManifest, "manifest", false, "Compare the hosts found with the manifest written by the boot command")
+	findCmd.Flags().StringVar(&args.Manifest, "manifest-path", "", "Path of the manifest to compare with (implies --manifest)")
 	return findCmd
 }
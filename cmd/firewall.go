@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/sralloza/rpi-provisioner/pkg/firewall"
+)
+
+func NewFirewallCmd() *cobra.Command {
+	args := firewall.FirewallArgs{}
+	flags := firewallRuleFlags{}
+	sshPort := 0
+	var firewallCmd = &cobra.Command{
+		Use:   "firewall",
+		Short: "Configure the firewall",
+		Long: `Deny all inbound traffic except ssh, the tailscale interface and the allowed ports,
+using ufw or nftables.
+
+Before applying the rules, a timer that restores the previous firewall is scheduled
+in the server. It is cancelled only after a new ssh connection succeeds, so a rule
+set that blocks ssh can't lock you out of the raspberry.`,
+		PreRunE: func(cmd *cobra.Command, posArgs []string) error {
+			if len(args.KeyPath) > 0 {
+				args.UseSSHKey = true
+			}
+			if !args.UseSSHKey && len(args.Password) == 0 {
+				return errors.New("must pass --ssh-key or --password")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			if sshPort == 0 {
+				sshPort = args.Port
+			}
+			rules, err := flags.rules(sshPort)
+			if err != nil {
+				return err
+			}
+			args.Rules = rules
+
+			err = firewall.Configure(args)
+			if err != nil {
+				return err
+			}
+			fmt.Println("\nFirewall configured successfully")
+			return nil
+		},
+	}
+
+	firewallCmd.Flags().BoolVar(&args.UseSSHKey, "ssh-key", false, "Use ssh key")
+	firewallCmd.Flags().StringVar(&args.KeyPath, "identity", "", "Private ssh key (implies --ssh-key, default ~/.ssh/id_rsa)")
+	firewallCmd.Flags().StringVar(&args.User, "user", "", "Login user")
+	firewallCmd.Flags().StringVar(&args.Password, "password", "", "Login password")
+	firewallCmd.Flags().StringVar(&args.Host, "host", "", "Server host")
+	firewallCmd.Flags().IntVar(&args.Port, "port", 22, "Server SSH port")
+	firewallCmd.Flags().IntVar(&sshPort, "ssh-port", 0, "SSH port allowed by the firewall (default --port)")
+	flags.register(firewallCmd, "")
+
+	firewallCmd.MarkFlagRequired("user")
+	firewallCmd.MarkFlagRequired("host")
+
+	return firewallCmd
+}
+
+// firewallRuleFlags are the flags of the firewall rules, shared with the
+// commands that configure the firewall after other tasks
+type firewallRuleFlags struct {
+	backend       string
+	allow         []string
+	noTailscale   bool
+	revertTimeout int
+}
+
+// register adds the flags to cmd, prefixing their names with prefix
+func (f *firewallRuleFlags) register(cmd *cobra.Command, prefix string) {
+	cmd.Flags().StringVar(&f.backend, prefix+"backend", firewall.BackendUFW, fmt.Sprintf("Firewall backend (%s)", strings.Join(firewall.Backends(), ", ")))
+	cmd.Flags().StringSliceVar(&f.allow, prefix+"allow", nil, "Allowed inbound ports, like 80, 443/tcp or 53/udp")
+	cmd.Flags().BoolVar(&f.noTailscale, prefix+"no-tailscale", false, "Don't allow the traffic of the tailscale interface")
+	cmd.Flags().IntVar(&f.revertTimeout, prefix+"revert-timeout", 120, "Seconds before the previous firewall is restored if the new ssh connection fails")
+}
+
+func (f *firewallRuleFlags) rules(sshPort int) (firewall.Rules, error) {
+	ports, err := firewall.ParsePorts(f.allow)
+	if err != nil {
+		return firewall.Rules{}, err
+	}
+	rules := firewall.Rules{
+		Backend:        f.backend,
+		SSHPort:        sshPort,
+		AllowTailscale: !f.noTailscale,
+		Ports:          ports,
+		RevertTimeout:  f.revertTimeout,
+	}
+	return rules, rules.Validate()
+}
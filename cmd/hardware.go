@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/sralloza/rpi-provisioner/pkg/boot"
+	"github.com/sralloza/rpi-provisioner/pkg/hardware"
+)
+
+func NewHardwareCmd() *cobra.Command {
+	args := hardware.HardwareArgs{}
+	var hardwareCmd = &cobra.Command{
+		Use:   "hardware",
+		Short: "Configure hardware options",
+		Long:  `Enable interfaces (i2c, spi, uart, camera), overlays and other hardware options in config.txt.`,
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			if args.Config.IsEmpty() {
+				return fmt.Errorf("no hardware option was passed")
+			}
+
+			result, err := hardware.NewManager().Setup(args)
+			if err != nil {
+				return err
+			}
+
+			if result.NeedReboot {
+				fmt.Printf("\nYou must restart the server to apply the changes\n"+
+					"    ssh %s@%s sudo reboot\n", args.User, args.Host)
+			}
+			return nil
+		},
+	}
+
+	hardwareCmd.Flags().BoolVar(&args.UseSSHKey, "ssh-key", false, "Use ssh key")
+	hardwareCmd.Flags().StringVar(&args.User, "user", "", "Login user")
+	hardwareCmd.Flags().StringVar(&args.Password, "password", "", "Login password")
+	hardwareCmd.Flags().StringVar(&args.Host, "host", "", "Server host")
+	hardwareCmd.Flags().IntVar(&args.Port, "port", 22, "Server SSH port")
+	addHardwareFlags(hardwareCmd, &args.Config)
+
+	hardwareCmd.MarkFlagRequired("user")
+	hardwareCmd.MarkFlagRequired("host")
+	return hardwareCmd
+}
+
+func addHardwareFlags(cmd *cobra.Command, args *boot.HardwareArgs) {
+	interfaces := strings.Join(boot.HardwareInterfaces(), ", ")
+	cmd.Flags().StringVar(&args.Section, "config-section", "all", "Section of config.txt where the settings are written (all, pi4, pi5...)")
+	cmd.Flags().StringSliceVar(&args.Enable, "enable", nil, "Interfaces to enable ("+interfaces+")")
+	cmd.Flags().StringSliceVar(&args.Disable, "disable", nil, "Interfaces to disable ("+interfaces+")")
+	cmd.Flags().IntVar(&args.GpuMem, "gpu-mem", 0, "GPU memory in MB")
+	cmd.Flags().StringArrayVar(&args.Overlays, "overlay", nil, "Device tree overlay with its params (e.g. dwc2 or gpio-fan,gpiopin=14)")
+	cmd.Flags().StringSliceVar(&args.RemoveOverlays, "remove-overlay", nil, "Device tree overlays to remove")
+	cmd.Flags().StringArrayVar(&args.Set, "config-set", nil, "Set a config.txt option (e.g. arm_64bit=1)")
+	cmd.Flags().StringSliceVar(&args.Unset, "config-unset", nil, "Remove a config.txt option")
+}
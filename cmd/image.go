@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/sralloza/rpi-provisioner/pkg/boot"
+	"github.com/sralloza/rpi-provisioner/pkg/image"
+)
+
+func NewImageCmd() *cobra.Command {
+	args := image.ImageArgs{}
+	flags := bootFlags{}
+	var imageCmd = &cobra.Command{
+		Use:   "image SOURCE TARGET",
+		Short: "Download, verify and flash an image",
+		Long: `Download the image (SOURCE can be a URL or a local path), verify its SHA-256 and write it
+to TARGET (a block device like /dev/sdb or a regular file). Compressed images (.xz, .gz)
+are decompressed while they are written. Downloaded images are cached.
+
+If --hostname (or --hostname-pattern) is passed, the boot partition is mounted after flashing and the boot setup
+is executed (linux only, requires root). Use --boot-path to run it on a boot partition you
+already mounted instead.`,
+		Args: cobra.ExactArgs(2),
+		PreRunE: func(cmd *cobra.Command, posArgs []string) error {
+			if cmd.Flags().Changed("boot-path") {
+				if !flags.hasHostname() {
+					return fmt.Errorf("you passed --boot-path, you need to specify --hostname or --hostname-pattern")
+				}
+				if !boot.IsDirectory(flags.args.BootPath) {
+					return fmt.Errorf("boot path '%s' is not a directory", flags.args.BootPath)
+				}
+			}
+			return flags.validate(cmd)
+		},
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			args.Source = posArgs[0]
+			args.Target = posArgs[1]
+			if flags.hasHostname() {
+				if err := flags.resolveHostname(); err != nil {
+					return err
+				}
+				args.Boot = &flags.args
+			}
+
+			result, err := image.NewManager().Flash(args, confirmOverwrite)
+			if err != nil {
+				return err
+			}
+			if args.Boot != nil && args.Boot.SerialConsole {
+				fmt.Printf("\n%s\n", boot.SerialConsoleWiring)
+			}
+
+			if result.NeedManualBoot {
+				fmt.Printf("\nThe boot partition can't be mounted automatically in this system.\n" +
+					"Mount it and run the boot command to finish the setup.\n")
+				return nil
+			}
+			if args.Boot != nil {
+				return flags.record()
+			}
+			return nil
+		},
+	}
+
+	imageCmd.Flags().StringVar(&args.SHA256, "sha256", "", "Expected SHA-256 of the image (defaults to the content of SOURCE.sha256 for URLs)")
+	imageCmd.Flags().BoolVar(&args.SkipVerify, "skip-verify", false, "Flash the image without verifying its SHA-256")
+	imageCmd.Flags().StringVar(&args.CacheDir, "cache-dir", defaultImageCacheDir(), "Directory where downloaded images are cached")
+	imageCmd.Flags().BoolVarP(&args.Yes, "yes", "y", false, "Overwrite TARGET without confirmation")
+	flags.register(imageCmd)
+	imageCmd.Flags().StringVar(&flags.args.BootPath, "boot-path", "", "Mounted boot partition of TARGET, the boot setup runs there instead of mounting it")
+
+	return imageCmd
+}
+
+func defaultImageCacheDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, "rpi-provisioner", "images")
+}
+
+func confirmOverwrite(target string) bool {
+	fmt.Printf("All the data in %s will be lost. Type 'yes' to continue: ", target)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(answer) == "yes"
+}
@@ -2,38 +2,131 @@ package cmd
 
 import (
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/sralloza/rpi-provisioner/pkg/layer1"
+	"github.com/sralloza/rpi-provisioner/pkg/secrets"
+	"github.com/sralloza/rpi-provisioner/pkg/sshd"
 )
 
+const generatedPasswordLength = 24
+
 func NewLayer1Cmd() *cobra.Command {
 	args := layer1.Layer1Args{}
+	rollback := false
+	generatePasswords := false
+	enableFirewall := false
+	firewallFlags := firewallRuleFlags{}
+	sshdProfile := ""
+	sshdAllowUsers := []string{}
+	sshdCiphers := []string{}
 	var layer1Cmd = &cobra.Command{
 		Use:   "layer1",
 		Short: "Provision layer 1",
 		Long: `Layer 1 uses the default user and bash shell. It will perform the following tasks:
  - Create deployer user
  - Setup ssh config and keys
- - Disable pi login
+ - [optional] firewall
+ - Disable pi login (or lock or delete the pi user)
  - [optional] static ip configuration
+
+If a step fails, the previous ones are rolled back. Use --rollback to restore the
+sudoers, sshd config and login user saved before layer1 was executed.
  `,
 		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			if len(args.KeyPath) > 0 {
+				args.LoginUseSSHKey = true
+			}
+			if rollback {
+				err := layer1.NewManager().Rollback(args)
+				if err != nil {
+					return err
+				}
+				fmt.Println("\nLayer 1 rolled back successfully")
+				fmt.Printf("The deployer user was not removed, you can delete it with:\n"+
+					"  ssh %s@%s sudo userdel -r %s\n", args.LoginUser, args.Host, args.DeployerUser)
+				return nil
+			}
+			var passwords *layer1Passwords
+			if generatePasswords {
+				store, err := openSecrets()
+				if err != nil {
+					return err
+				}
+				passwords, err = generateLayer1Passwords(store, &args)
+				if err != nil {
+					return err
+				}
+			}
+			if len(args.DeployerPassword) == 0 {
+				return fmt.Errorf("required flag \"deployer-password\" not set")
+			}
+			if len(args.KeysUri) == 0 {
+				return fmt.Errorf("required flag \"keys-uri\" not set")
+			}
+
+			profile, err := sshd.GetProfile(sshdProfile)
+			if err != nil {
+				return err
+			}
+			if cmd.Flags().Changed("sshd-allow-users") {
+				profile.AllowUsers = sshdAllowUsers
+			} else if sshdProfile == "strict" {
+				profile.AllowUsers = []string{args.DeployerUser}
+			}
+			if cmd.Flags().Changed("sshd-ciphers") {
+				profile.Ciphers = sshdCiphers
+			}
+			if !profile.AllowsUser(args.DeployerUser) {
+				return fmt.Errorf("--sshd-allow-users must include the deployer user %s", args.DeployerUser)
+			}
+			args.SSHD = profile
+			if enableFirewall {
+				rules, err := firewallFlags.rules(args.Port)
+				if err != nil {
+					return err
+				}
+				args.Firewall = &rules
+			}
+			if !slices.Contains(layer1.LoginUserActions(), args.LoginUserAction) {
+				return fmt.Errorf("invalid login user action: %q (valid: %s)",
+					args.LoginUserAction, strings.Join(layer1.LoginUserActions(), ", "))
+			}
 			if args.IpAddress != nil {
 				fmt.Print(networkWarning)
 			}
 
 			layer1Result, err := layer1.NewManager().Provision(args)
+			if passwords != nil {
+				if saveErr := passwords.save(layer1Result.PasswordsSet); saveErr != nil {
+					if err != nil {
+						return fmt.Errorf("%w (%s)", err, saveErr)
+					}
+					return saveErr
+				}
+			}
 			if err != nil {
 				return err
 			}
 
-			if layer1Result.ConnectionError {
-				fmt.Println("\nSSH Connection error, layer 1 should be provisioned")
+			if layer1Result.AlreadyProvisioned {
+				fmt.Printf("\n%s is disabled and %s can login, layer 1 is already provisioned\n", args.LoginUser, args.DeployerUser)
 				return nil
 			}
 
 			fmt.Println("\nLayer 1 provisioned successfully")
+			if generatePasswords {
+				fmt.Println("\nThe generated passwords are saved in the secrets file, show them with:")
+				fmt.Printf("  rpi-provisioner secrets show %s\n", args.Host)
+			}
+			if len(layer1Result.SSHDSettings) > 0 {
+				fmt.Println("\nEffective sshd settings:")
+				for _, setting := range layer1Result.SSHDSettings {
+					fmt.Printf("  %s\n", setting)
+				}
+			}
 			if layer1Result.NeedRestartForDHCPCleanup {
 				newHost := args.Host
 				if args.IpAddress != nil {
@@ -53,18 +146,85 @@ func NewLayer1Cmd() *cobra.Command {
 	}
 
 	layer1Cmd.Flags().StringVar(&args.LoginUser, "login-user", "pi", "Login user")
-	layer1Cmd.Flags().StringVar(&args.LoginPassword, "login-password", "raspberry", "Login password")
-	layer1Cmd.Flags().StringVar(&args.DeployerPassword, "deployer-user", "", "Deployer user")
-	layer1Cmd.Flags().StringVar(&args.DeployerUser, "deployer-password", "", "Deployer password")
+	layer1Cmd.Flags().StringVar(&args.LoginPassword, "login-password", "raspberry", "Login password (also used by sudo if the login user doesn't have passwordless sudo)")
+	layer1Cmd.Flags().BoolVar(&args.LoginUseSSHKey, "ssh-key", false, "Login with the ssh key instead of the password")
+	layer1Cmd.Flags().StringVar(&args.KeyPath, "identity", "", "Private ssh key used by the login user (implies --ssh-key) and the deployer user (default ~/.ssh/id_rsa)")
+	layer1Cmd.Flags().StringVar(&args.DeployerUser, "deployer-user", "", "Deployer user")
+	layer1Cmd.Flags().StringVar(&args.DeployerPassword, "deployer-password", "", "Deployer password")
 	layer1Cmd.Flags().StringVar(&args.RootPassword, "root-password", "", "Root password")
+	layer1Cmd.Flags().BoolVar(&generatePasswords, "generate-passwords", false, "Generate the deployer and root passwords not passed and save them in the encrypted secrets file")
 	layer1Cmd.Flags().StringVar(&args.Host, "host", "", "Server host")
 	layer1Cmd.Flags().IntVar(&args.Port, "port", 22, "Server SSH port")
 	layer1Cmd.Flags().StringVar(&args.KeysUri, "keys-uri", "", "Keys uri. Can be a AWS S3 URI, HTTP(S) or a file path.")
 	layer1Cmd.Flags().IPVar(&args.IpAddress, "ip", nil, "Static IP")
+	layer1Cmd.Flags().StringArrayVar(&args.SudoCommands, "sudo-command", nil, "Command the deployer can run with sudo (absolute path with arguments). It can be repeated, defaults to all commands")
+	layer1Cmd.Flags().BoolVar(&args.SudoRequirePassword, "sudo-password-required", false, "Ask for the deployer password when using sudo")
+	layer1Cmd.Flags().StringVar(&sshdProfile, "sshd-profile", "basic", fmt.Sprintf("Hardening profile of sshd (%s)", strings.Join(sshd.Profiles(), ", ")))
+	layer1Cmd.Flags().StringSliceVar(&sshdAllowUsers, "sshd-allow-users", nil, "Users allowed to login via ssh (the strict profile defaults to the deployer user)")
+	layer1Cmd.Flags().StringSliceVar(&sshdCiphers, "sshd-ciphers", nil, "Ciphers allowed by sshd (overrides the ones of the profile)")
+	layer1Cmd.Flags().StringVar(&args.LoginUserAction, "login-user-action", layer1.LoginUserDisable, fmt.Sprintf("Action applied to the login user after verifying the deployer login (%s)", strings.Join(layer1.LoginUserActions(), ", ")))
+	layer1Cmd.Flags().BoolVar(&enableFirewall, "firewall", false, "Configure the firewall (default deny inbound, allow ssh, tailscale and the --firewall-allow ports)")
+	firewallFlags.register(layer1Cmd, "firewall-")
+	layer1Cmd.Flags().BoolVar(&rollback, "rollback", false, "Restore the state saved before layer1 was executed (connects as the deployer user with the ssh key, pass --deployer-password if it needs a password for sudo)")
 
 	layer1Cmd.MarkFlagRequired("deployer-user")
-	layer1Cmd.MarkFlagRequired("deployer-password")
 	layer1Cmd.MarkFlagRequired("host")
-	layer1Cmd.MarkFlagRequired("keysUri")
 	return layer1Cmd
 }
+
+// layer1Passwords are the deployer and root passwords of --generate-passwords.
+// The ones already saved for the host are reused, and the new ones are only
+// saved once they are set in the server, so the secrets store always matches
+// it.
+type layer1Passwords struct {
+	store     *secrets.Store
+	host      string
+	generated map[string]string
+}
+
+// generateLayer1Passwords fills the deployer and root passwords not passed by
+// the user with the saved ones, or generates them
+func generateLayer1Passwords(store *secrets.Store, args *layer1.Layer1Args) (*layer1Passwords, error) {
+	passwords := &layer1Passwords{store: store, host: args.Host, generated: map[string]string{}}
+	var err error
+	if len(args.DeployerPassword) == 0 {
+		args.DeployerPassword, err = passwords.get(args.DeployerUser)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(args.RootPassword) == 0 {
+		args.RootPassword, err = passwords.get("root")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return passwords, nil
+}
+
+func (p *layer1Passwords) get(user string) (string, error) {
+	if password, ok := p.store.Password(p.host, user); ok {
+		return password, nil
+	}
+	password, err := secrets.GeneratePassword(generatedPasswordLength)
+	if err != nil {
+		return "", err
+	}
+	p.generated[user] = password
+	return password, nil
+}
+
+// save stores the generated passwords of the users whose password was set
+func (p *layer1Passwords) save(passwordsSet []string) error {
+	changed := false
+	for _, user := range passwordsSet {
+		if password, ok := p.generated[user]; ok {
+			p.store.Set(p.host, user, password)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return p.store.Save()
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/sralloza/rpi-provisioner/pkg/layer1"
+	"github.com/sralloza/rpi-provisioner/pkg/secrets"
+)
+
+func TestLayer1PasswordsSavedOnlyWhenSet(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	store, err := secrets.Load("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := layer1.Layer1Args{Host: "rpi", DeployerUser: "deployer"}
+	passwords, err := generateLayer1Passwords(store, &args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(args.DeployerPassword) == 0 || len(args.RootPassword) == 0 {
+		t.Fatalf("passwords not generated: %+v", args)
+	}
+
+	// The run failed or was rolled back before setting any password
+	if err := passwords.save(nil); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := secrets.Exists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatal("secrets saved without setting any password")
+	}
+
+	// Only the deployer password was set
+	if err := passwords.save([]string{"deployer"}); err != nil {
+		t.Fatal(err)
+	}
+	store, err = secrets.Load("passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password, _ := store.Password("rpi", "deployer"); password != args.DeployerPassword {
+		t.Errorf("deployer password = %q, want %q", password, args.DeployerPassword)
+	}
+	if _, ok := store.Password("rpi", "root"); ok {
+		t.Error("root password saved but it wasn't set")
+	}
+
+	// A new run reuses the saved deployer password
+	rerun := layer1.Layer1Args{Host: "rpi", DeployerUser: "deployer"}
+	if _, err := generateLayer1Passwords(store, &rerun); err != nil {
+		t.Fatal(err)
+	}
+	if rerun.DeployerPassword != args.DeployerPassword {
+		t.Errorf("deployer password not reused: %q, want %q", rerun.DeployerPassword, args.DeployerPassword)
+	}
+	if rerun.RootPassword == args.RootPassword {
+		t.Error("root password reused but it was never saved")
+	}
+}
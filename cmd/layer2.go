@@ -2,14 +2,17 @@ package cmd
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/sralloza/rpi-provisioner/pkg/layer2"
+	"github.com/sralloza/rpi-provisioner/pkg/updates"
 
 	"github.com/spf13/cobra"
 )
 
 func NewLayer2Cmd() *cobra.Command {
-	args := layer2.Layer2Args{}
+	args := layer2.Layer2Args{Upgrades: updates.DefaultConfig()}
+	noReboot := false
 	var layer2Cmd = &cobra.Command{
 		Use:   "layer2",
 		Short: "Provision layer 2",
@@ -20,9 +23,15 @@ func NewLayer2Cmd() *cobra.Command {
 - Install oh-my-zsh
 - Install tailsafe
 - Configure tailsafe (if auth-key is provided)
+- Install fail2ban with a jail for ssh
+- Install and configure unattended-upgrades
 - Install docker
 `,
 		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			args.Upgrades.AutomaticReboot = !noReboot
+			if err := args.Upgrades.Validate(); err != nil {
+				return err
+			}
 			layer2Result, err := layer2.NewManager().Provision(args)
 			if err != nil {
 				return err
@@ -53,6 +62,13 @@ func NewLayer2Cmd() *cobra.Command {
 	layer2Cmd.Flags().StringVar(&args.Host, "host", "", "Server host")
 	layer2Cmd.Flags().IntVar(&args.Port, "port", 22, "Server SSH port")
 	layer2Cmd.Flags().StringVar(&args.TailscaleAuthKey, "ts-auth-key", "", "Tailscale auth key")
+	layer2Cmd.Flags().StringSliceVar(&args.Fail2banIgnoreIPs, "fail2ban-ignore-ip", nil, "IPs or networks never banned by fail2ban (tailscale and the local subnets are always ignored)")
+
+	layer2Cmd.Flags().StringArrayVar(&args.Upgrades.Origins, "upgrades-origin", nil, "Origins-Pattern of the packages upgraded automatically. It can be repeated, defaults to the security updates and the Raspberry Pi repository")
+	layer2Cmd.Flags().StringVar(&args.Upgrades.RebootTime, "upgrades-reboot-time", args.Upgrades.RebootTime, "Time of the automatic reboot when an upgrade requires it (HH:MM)")
+	layer2Cmd.Flags().BoolVar(&noReboot, "upgrades-no-reboot", false, "Don't reboot automatically when an upgrade requires it")
+	layer2Cmd.Flags().StringVar(&args.Upgrades.Mail, "upgrades-mail", args.Upgrades.Mail, "Address of the upgrades report, empty to disable it")
+	layer2Cmd.Flags().StringVar(&args.Upgrades.MailReport, "upgrades-mail-report", args.Upgrades.MailReport, fmt.Sprintf("When the upgrades report is sent (%s)", strings.Join(updates.MailReports(), ", ")))
 
 	layer2Cmd.MarkFlagRequired("user")
 	layer2Cmd.MarkFlagRequired("host")
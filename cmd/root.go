@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
 )
 
 var rootCmd = &cobra.Command{
@@ -27,6 +28,8 @@ func Execute() {
 }
 
 func init() {
+	rootCmd.PersistentFlags().BoolVar(&ssh.StrictHostKeys, "strict-host-keys", false, "Reject ssh connections to known hosts whose key changed (checked with ~/.ssh/known_hosts)")
+
 	rootCmd.AddCommand(NewLayer1Cmd())
 	rootCmd.AddCommand(NewLayer2Cmd())
 
@@ -34,4 +37,12 @@ func init() {
 	rootCmd.AddCommand(NewNetworkingCmd())
 	rootCmd.AddCommand(NewBootCmd())
 	rootCmd.AddCommand(NewFindCommand())
+	rootCmd.AddCommand(NewHardwareCmd())
+	rootCmd.AddCommand(NewImageCmd())
+	rootCmd.AddCommand(NewUsersCmd())
+	rootCmd.AddCommand(NewSecretsCmd())
+	rootCmd.AddCommand(NewFirewallCmd())
+	rootCmd.AddCommand(NewSSHPortCmd())
+	rootCmd.AddCommand(NewBansCmd())
+	rootCmd.AddCommand(NewUpdatesCmd())
 }
@@ -0,0 +1,156 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/sralloza/rpi-provisioner/pkg/secrets"
+	"golang.org/x/term"
+)
+
+func NewSecretsCmd() *cobra.Command {
+	var secretsCmd = &cobra.Command{
+		Use:   "secrets",
+		Short: "Manage the passwords generated by layer1",
+		Long: fmt.Sprintf(`The passwords generated with layer1 --generate-passwords are saved encrypted
+with a passphrase in the secrets file of the config directory.
+
+The passphrase is read from the %s environment variable,
+or asked interactively if it is not set.`, secrets.PassphraseEnv),
+	}
+
+	secretsCmd.AddCommand(NewSecretsListCmd())
+	secretsCmd.AddCommand(NewSecretsShowCmd())
+	secretsCmd.AddCommand(NewSecretsDeleteCmd())
+	return secretsCmd
+}
+
+func NewSecretsListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list",
+		Short: "List the hosts and users with saved passwords",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			store, err := loadSecrets()
+			if err != nil {
+				return err
+			}
+			for _, host := range store.HostNames() {
+				fmt.Println(host)
+				hostSecrets, _ := store.Get(host)
+				for _, secret := range hostSecrets {
+					fmt.Printf("  %s (%s)\n", secret.User, secret.UpdatedAt.Format("2006-01-02 15:04:05"))
+				}
+			}
+			return nil
+		},
+	}
+}
+
+func NewSecretsShowCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "show HOST",
+		Short: "Show the passwords of a host",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			store, err := loadSecrets()
+			if err != nil {
+				return err
+			}
+			hostSecrets, ok := store.Get(posArgs[0])
+			if !ok {
+				return fmt.Errorf("no secrets found for %s", posArgs[0])
+			}
+			for _, secret := range hostSecrets {
+				fmt.Printf("%s: %s\n", secret.User, secret.Password)
+			}
+			return nil
+		},
+	}
+}
+
+func NewSecretsDeleteCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "delete HOST",
+		Short: "Delete the passwords of a host",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			store, err := loadSecrets()
+			if err != nil {
+				return err
+			}
+			if !store.Delete(posArgs[0]) {
+				return fmt.Errorf("no secrets found for %s", posArgs[0])
+			}
+			return store.Save()
+		},
+	}
+}
+
+// loadSecrets opens the secrets store, which must exist
+func loadSecrets() (*secrets.Store, error) {
+	exists, err := secrets.Exists()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("there are no secrets saved, generate them with layer1 --generate-passwords")
+	}
+	passphrase, err := readPassphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	return secrets.Load(passphrase)
+}
+
+// readPassphrase returns the passphrase of the secrets store. If confirm is
+// true and it is asked interactively, it must be typed twice.
+func readPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv(secrets.PassphraseEnv); len(passphrase) > 0 {
+		return passphrase, nil
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return "", fmt.Errorf("can't ask for the secrets passphrase, set %s", secrets.PassphraseEnv)
+	}
+
+	fmt.Print("Secrets passphrase: ")
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", fmt.Errorf("error reading passphrase: %w", err)
+	}
+	if len(passphrase) == 0 {
+		return "", errors.New("the passphrase can't be empty")
+	}
+
+	if confirm {
+		fmt.Print("Repeat passphrase: ")
+		repeated, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", fmt.Errorf("error reading passphrase: %w", err)
+		}
+		if string(repeated) != string(passphrase) {
+			return "", errors.New("the passphrases don't match")
+		}
+	}
+	return string(passphrase), nil
+}
+
+// openSecrets opens the secrets store, or an empty one if it doesn't exist
+// (the passphrase is asked twice to create it)
+func openSecrets() (*secrets.Store, error) {
+	exists, err := secrets.Exists()
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := readPassphrase(!exists)
+	if err != nil {
+		return nil, err
+	}
+	return secrets.Load(passphrase)
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/sralloza/rpi-provisioner/pkg/sshport"
+)
+
+func NewSSHPortCmd() *cobra.Command {
+	args := sshport.SSHPortArgs{}
+	var sshPortCmd = &cobra.Command{
+		Use:   "ssh-port",
+		Short: "Move SSH to another port",
+		Long: `Change the port sshd listens on. The new port is opened in the firewall (if any) and
+sshd listens on both ports until a new connection to the new port succeeds. Then the
+old port is closed and the host keys are saved in known_hosts for the new port.`,
+		PreRunE: func(cmd *cobra.Command, posArgs []string) error {
+			if len(args.KeyPath) > 0 {
+				args.UseSSHKey = true
+			}
+			if !args.UseSSHKey && len(args.Password) == 0 {
+				return errors.New("must pass --ssh-key or --password")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			result, err := sshport.NewManager().Change(args)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("\nSSH moved to port %d successfully\n", args.NewPort)
+			for _, address := range result.KnownHosts {
+				fmt.Printf("  known_hosts: %s\n", address)
+			}
+			fmt.Println("\nConnect with:")
+			fmt.Printf("  ssh -p %d %s@%s\n", args.NewPort, args.User, args.Host)
+			fmt.Println("Remember to pass --port to the other commands")
+			return nil
+		},
+	}
+
+	sshPortCmd.Flags().BoolVar(&args.UseSSHKey, "ssh-key", false, "Use ssh key")
+	sshPortCmd.Flags().StringVar(&args.KeyPath, "identity", "", "Private ssh key (implies --ssh-key, default ~/.ssh/id_rsa)")
+	sshPortCmd.Flags().StringVar(&args.User, "user", "", "Login user")
+	sshPortCmd.Flags().StringVar(&args.Password, "password", "", "Login password")
+	sshPortCmd.Flags().StringVar(&args.Host, "host", "", "Server host")
+	sshPortCmd.Flags().IntVar(&args.Port, "port", 22, "Current SSH port")
+	sshPortCmd.Flags().IntVar(&args.NewPort, "new-port", 0, "New SSH port")
+
+	sshPortCmd.MarkFlagRequired("user")
+	sshPortCmd.MarkFlagRequired("host")
+	sshPortCmd.MarkFlagRequired("new-port")
+
+	return sshPortCmd
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/sralloza/rpi-provisioner/pkg/updates"
+)
+
+func NewUpdatesCmd() *cobra.Command {
+	var updatesCmd = &cobra.Command{
+		Use:   "updates",
+		Short: "Check the package updates of the servers",
+	}
+
+	updatesCmd.AddCommand(NewUpdatesStatusCmd())
+	return updatesCmd
+}
+
+func NewUpdatesStatusCmd() *cobra.Command {
+	args := updates.StatusArgs{}
+	var statusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the pending upgrades and if a reboot is required",
+		Long: `Show, for each host, the packages with a pending upgrade (and how many of them are
+security updates) and if a reboot is required to finish an upgrade.
+
+The pending upgrades are based on the package lists of the server, which are updated
+daily by unattended-upgrades (configured by layer2). Use --refresh to update them first.`,
+		PreRunE: func(cmd *cobra.Command, posArgs []string) error {
+			if len(args.KeyPath) > 0 {
+				args.UseSSHKey = true
+			}
+			if !args.UseSSHKey && len(args.Password) == 0 {
+				return errors.New("must pass --ssh-key or --password")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			statuses := updates.Status(args)
+
+			fmt.Println()
+			writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(writer, "HOST\tPENDING\tSECURITY\tREBOOT REQUIRED")
+			failed := 0
+			for _, status := range statuses {
+				if status.Err != nil {
+					failed++
+					fmt.Fprintf(writer, "%s\t-\t-\t-\n", status.Host)
+					continue
+				}
+				reboot := yesNo(status.RebootRequired)
+				if len(status.RebootPackages) > 0 {
+					reboot += fmt.Sprintf(" (%s)", strings.Join(status.RebootPackages, ", "))
+				}
+				fmt.Fprintf(writer, "%s\t%d\t%d\t%s\n", status.Host, len(status.Pending), len(status.Security), reboot)
+			}
+			writer.Flush()
+
+			if failed == 0 {
+				return nil
+			}
+			fmt.Println()
+			for _, status := range statuses {
+				if status.Err != nil {
+					fmt.Printf("%s: %s\n", status.Host, status.Err)
+				}
+			}
+			return fmt.Errorf("couldn't get the status of %d hosts", failed)
+		},
+	}
+
+	statusCmd.Flags().BoolVar(&args.UseSSHKey, "ssh-key", false, "Use ssh key")
+	statusCmd.Flags().StringVar(&args.KeyPath, "identity", "", "Private ssh key (implies --ssh-key, default ~/.ssh/id_rsa)")
+	statusCmd.Flags().StringVar(&args.User, "user", "", "Login user")
+	statusCmd.Flags().StringVar(&args.Password, "password", "", "Login password")
+	statusCmd.Flags().StringSliceVar(&args.Hosts, "host", nil, "Server hosts, separated by commas")
+	statusCmd.Flags().IntVar(&args.Port, "port", 22, "Server SSH port")
+	statusCmd.Flags().BoolVar(&args.Refresh, "refresh", false, "Update the package lists before checking the upgrades (requires sudo)")
+
+	statusCmd.MarkFlagRequired("user")
+	statusCmd.MarkFlagRequired("host")
+
+	return statusCmd
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+	"github.com/sralloza/rpi-provisioner/pkg/users"
+)
+
+func NewUsersCmd() *cobra.Command {
+	args := users.UsersArgs{}
+	var usersCmd = &cobra.Command{
+		Use:   "users",
+		Short: "Manage users and groups",
+		Long: `Create, update and remove the users and groups listed in a JSON file. For each user
+it manages its shell, supplementary groups, sudo access and authorized keys.`,
+		PreRunE: func(cmd *cobra.Command, posArgs []string) error {
+			if !args.UseSSHKey && len(args.Password) == 0 {
+				return errors.New("must pass --ssh-key or --password")
+			}
+			return nil
+		},
+		RunE: func(cmd *cobra.Command, posArgs []string) error {
+			return users.NewManager().Apply(args)
+		},
+	}
+
+	usersCmd.Flags().BoolVar(&args.UseSSHKey, "ssh-key", false, "Use ssh key")
+	usersCmd.Flags().StringVar(&args.User, "user", "", "Login user")
+	usersCmd.Flags().StringVar(&args.Password, "password", "", "Login password")
+	usersCmd.Flags().StringVar(&args.Host, "host", "", "Server host")
+	usersCmd.Flags().IntVar(&args.Port, "port", 22, "Server SSH port")
+	usersCmd.Flags().StringVar(&args.DeployerUser, "deployer-user", "", "Deployer user, it can't be removed or lose its sudo access (like --user)")
+	usersCmd.Flags().StringVar(&args.File, "file", "", "JSON file with the users and groups")
+
+	usersCmd.MarkFlagRequired("user")
+	usersCmd.MarkFlagRequired("host")
+	usersCmd.MarkFlagRequired("file")
+
+	return usersCmd
+}
@@ -10,7 +10,9 @@ require (
 	github.com/pkg/sftp v1.10.1
 	github.com/rs/zerolog v1.31.0
 	github.com/spf13/cobra v1.2.1
+	github.com/ulikunitz/xz v0.5.12
 	golang.org/x/crypto v0.13.0
+	golang.org/x/term v0.12.0
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1
 )
 
@@ -15,15 +15,22 @@ type UploadsshKeysArgs struct {
 	KeysUri  string
 }
 
+// UploadsshKeys replaces the authorized_keys of the user. The commands are
+// executed with sudo, so the keys of any user can be updated.
 func UploadsshKeys(conn ssh.SSHConnection, args UploadsshKeysArgs) (bool, error) {
-	mkdirCmd := fmt.Sprintf("mkdir -p /home/%s/.ssh", args.User)
-	_, _, err := conn.Run(mkdirCmd)
+	home := fmt.Sprintf("/home/%s", args.User)
+	if stdout, _, err := conn.Run(fmt.Sprintf("getent passwd %s | cut -d: -f6", args.User)); err == nil && len(strings.TrimSpace(stdout)) > 0 {
+		home = strings.TrimSpace(stdout)
+	}
+
+	mkdirCmd := fmt.Sprintf("mkdir -p %s/.ssh", home)
+	_, _, err := conn.RunSudoPassword(mkdirCmd, args.Password)
 	if err != nil {
 		return false, fmt.Errorf("error creating user's ssh directory: %w", err)
 	}
 
-	catCmd := fmt.Sprintf("cat /home/%s/.ssh/authorized_keys", args.User)
-	fileContent, _, err := conn.Run(catCmd)
+	catCmd := fmt.Sprintf("cat %s/.ssh/authorized_keys", home)
+	fileContent, _, err := conn.RunSudoPassword(catCmd, args.Password)
 
 	var authorizedKeys []string
 	if err != nil {
@@ -60,13 +67,13 @@ func UploadsshKeys(conn ssh.SSHConnection, args UploadsshKeysArgs) (bool, error)
 		}
 	}
 
-	updateKeysCmd := fmt.Sprintf("echo \"%s\" > /home/%s/.ssh/authorized_keys", newFileContent, args.User)
+	updateKeysCmd := fmt.Sprintf("echo \"%s\" > %s/.ssh/authorized_keys", newFileContent, home)
 	_, _, err = conn.RunSudoPassword(updateKeysCmd, args.Password)
 	if err != nil {
 		return false, fmt.Errorf("error updating authorized_keys: %w", err)
 	}
 
-	sshFolder := fmt.Sprintf("/home/%s/.ssh", args.User)
+	sshFolder := fmt.Sprintf("%s/.ssh", home)
 	authorizedKeysPath := fmt.Sprintf("%s/authorized_keys", sshFolder)
 
 	chmodsshCmd := fmt.Sprintf("chmod 700 %s", sshFolder)
@@ -0,0 +1,137 @@
+package boot
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+)
+
+// Directory in the boot partition where the original files are saved the
+// first time the boot command is executed
+const backupDir = "rpi-provisioner-backup"
+
+// Files of the boot partition that the boot command creates or modifies
+var managedFiles = []string{
+	"cmdline.txt",
+	"config.txt",
+	"ssh",
+	"firstrun.sh",
+	"user-data",
+	"network-config",
+	"meta-data",
+	hooksDir,
+	firstRunLog,
+}
+
+// backup saves the managed files that exist in the boot partition. It only
+// runs once, so the backup always contains the original files of the image.
+// The files are copied to a temporary directory that is renamed at the end,
+// so a failed backup is not mistaken for a complete one.
+func (b BootManager) backup(bootPath string) error {
+	info.Title("Backing up boot files")
+
+	backupPath := filepath.Join(bootPath, backupDir)
+	if IsDirectory(backupPath) {
+		info.Skipped()
+		return nil
+	}
+
+	tmpPath := backupPath + ".tmp"
+	err := os.RemoveAll(tmpPath)
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("error removing incomplete backup: %w", err)
+	}
+	err = os.Mkdir(tmpPath, 0755)
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("error creating backup directory: %w", err)
+	}
+
+	for _, name := range managedFiles {
+		if IsDirectory(filepath.Join(bootPath, name)) {
+			continue
+		}
+		err = copyFile(filepath.Join(bootPath, name), filepath.Join(tmpPath, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			info.Fail()
+			os.RemoveAll(tmpPath)
+			return fmt.Errorf("error backing up %s: %w", name, err)
+		}
+	}
+
+	err = os.Rename(tmpPath, backupPath)
+	if err != nil {
+		info.Fail()
+		os.RemoveAll(tmpPath)
+		return fmt.Errorf("error saving backup: %w", err)
+	}
+
+	info.Ok()
+	return nil
+}
+
+// Revert restores the original files of the boot partition and removes the
+// ones created by the boot command.
+func (b BootManager) Revert(bootPath string) error {
+	backupPath := filepath.Join(bootPath, backupDir)
+	if !IsDirectory(backupPath) {
+		return fmt.Errorf("backup not found in %s, the boot command was not executed", bootPath)
+	}
+
+	for _, name := range managedFiles {
+		filePath := filepath.Join(bootPath, name)
+		backupFilePath := filepath.Join(backupPath, name)
+
+		if _, err := os.Stat(backupFilePath); err == nil {
+			info.Title("Restoring %s", name)
+			if err := copyFile(backupFilePath, filePath); err != nil {
+				info.Fail()
+				return fmt.Errorf("error restoring %s: %w", name, err)
+			}
+			info.Ok()
+			continue
+		}
+
+		if _, err := os.Stat(filePath); err == nil {
+			info.Title("Removing %s", name)
+			if err := os.RemoveAll(filePath); err != nil {
+				info.Fail()
+				return fmt.Errorf("error removing %s: %w", name, err)
+			}
+			info.Ok()
+		}
+	}
+
+	info.Title("Removing backup")
+	if err := os.RemoveAll(backupPath); err != nil {
+		info.Fail()
+		return fmt.Errorf("error removing backup directory: %w", err)
+	}
+	info.Ok()
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, content, 0644)
+}
+
+func IsDirectory(path string) bool {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+
+	return fileInfo.IsDir()
+}
@@ -4,19 +4,56 @@ import (
 	"bytes"
 	_ "embed"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
 	"text/template"
 
+	"github.com/sralloza/rpi-provisioner/pkg/authorizedkeys"
 	"github.com/sralloza/rpi-provisioner/pkg/info"
 )
 
+// Default user created during the first boot (password: raspberry)
+const (
+	defaultUser             = "pi"
+	defaultUserPasswordHash = "$5$HJZCM0zQBW$j180ikBrviUrx.n4evIc1XhOSf.B58eeVZvZY68eIM1"
+)
+
 type BootArgs struct {
-	Country  string
-	WifiSSID string
-	WifiPass string
+	BootPath    string
+	Hostname    string
+	WifiCountry string
+	WifiSSID    string
+	WifiPass    string
+	KeysUri     string
+	Timezone    string
+	Locale      string
+	Keymap      string
+	StaticIP    *StaticIP
+	Hardware    HardwareArgs
+	// Configure the raspberry as an ethernet device over USB (usb0)
+	UsbGadget   bool
+	UsbGadgetIP *net.IPNet
+	// Enable the UART and a login console on it (GPIO14/GPIO15)
+	SerialConsole bool
+	// Scripts executed in order at the end of the first boot
+	Hooks []string
+	// Path of a template that replaces the embedded firstrun.sh template
+	Template string
+	// Generate the ssh host keys and add them to the local known_hosts
+	HostKeys bool
+}
+
+// StaticIP is the network configuration applied to an interface during the
+// first boot instead of DHCP
+type StaticIP struct {
+	// Interface with the static IP (eth0 or wlan0), the other ones use DHCP
+	Interface string
+	// IP address and mask (e.g. 192.168.1.50/24)
+	Address *net.IPNet
+	Gateway net.IP
+	DNS     []net.IP
 }
 
 //go:embed firstrun.tmpl
@@ -29,25 +66,110 @@ func NewBootManager() *BootManager {
 	return &BootManager{}
 }
 
-func (b BootManager) Setup(bootPath, hostname, wifiCountry, wifiSSID, wifiPassword string) error {
-	err := b.enableSSH(bootPath)
+func (b BootManager) Setup(args BootArgs) error {
+	authorizedKeys, err := b.getAuthorizedKeys(args.KeysUri)
 	if err != nil {
 		return err
 	}
 
-	err = b.firstRunScript(bootPath, hostname, wifiSSID, wifiPassword, wifiCountry)
+	cloudInit := IsCloudInit(args.BootPath)
+	if cloudInit && len(args.Template) > 0 {
+		return fmt.Errorf("the image uses cloud-init, a firstrun.sh template can't be used")
+	}
+
+	err = b.backup(args.BootPath)
 	if err != nil {
 		return err
 	}
 
-	err = b.updateCmdArgs(bootPath)
+	hooks, err := b.copyHooks(args.BootPath, args.Hooks)
 	if err != nil {
 		return err
 	}
 
+	err = b.enableSSH(args.BootPath)
+	if err != nil {
+		return err
+	}
+
+	data := newTemplateData(args, authorizedKeys, hooks)
+	if args.HostKeys {
+		data.HostKeys, err = b.generateHostKeys()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The cmdline edits go before updateCmdArgs, which keeps the systemd.run
+	// parameters last (the firstrun script removes everything after them)
+	if args.UsbGadget {
+		err = b.enableUsbGadget(args.BootPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.SerialConsole {
+		err = b.enableSerialConsole(args.BootPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cloudInit {
+		err = b.cloudInit(args.BootPath, data)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = b.firstRunScript(args, data)
+		if err != nil {
+			return err
+		}
+
+		err = b.updateCmdArgs(args.BootPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !args.Hardware.IsEmpty() {
+		err = b.updateConfigTxt(args.BootPath, args.Hardware)
+		if err != nil {
+			return err
+		}
+	}
+
+	if args.HostKeys {
+		err = b.addKnownHosts(args, data.HostKeys)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+func (b BootManager) getAuthorizedKeys(keysUri string) ([]string, error) {
+	if len(keysUri) == 0 {
+		return nil, nil
+	}
+
+	info.Title("Getting authorized keys")
+	keys, err := authorizedkeys.Get(keysUri)
+	if err != nil {
+		info.Fail()
+		return nil, fmt.Errorf("error getting authorized keys: %w", err)
+	}
+
+	result := []string{}
+	for _, key := range keys {
+		result = append(result, key.String())
+	}
+	info.Ok()
+	return result, nil
+}
+
 func (b BootManager) enableSSH(bootPath string) error {
 	info.Title("Enabling ssh")
 	emptyFile, err := os.Create(filepath.Join(bootPath, "ssh"))
@@ -60,46 +182,105 @@ func (b BootManager) enableSSH(bootPath string) error {
 	return nil
 }
 
-type firstRunScriptData struct {
-	Hostname    string
-	WifiSSID    string
-	WifiPass    string
-	WifiCountry string
+type templateData struct {
+	Hostname         string
+	User             string
+	UserPasswordHash string
+	AuthorizedKeys   []string
+	WifiSSID         string
+	WifiPass         string
+	WifiCountry      string
+	Timezone         string
+	Locale           string
+	Keymap           string
+	Interfaces       []networkInterface
+	Hooks            []string
+	HooksDir         string
+	FirstRunLog      string
+	HostKeys         []hostKey
 }
 
-func (b BootManager) firstRunScript(bootPath, hostname, wifiSSID, wifiPass, country string) error {
-	info.Title("Setting up first run script")
+type networkInterface struct {
+	Name string
+	Wifi bool
+	// Address in CIDR notation, empty if the interface uses DHCP
+	Address string
+	Gateway string
+	DNS     []string
+	Metric  int
+}
 
-	if firstRunTemplate == "" {
-		info.Fail()
-		return fmt.Errorf("embedded template is empty")
+func newTemplateData(args BootArgs, authorizedKeys, hooks []string) templateData {
+	return templateData{
+		Hostname:         args.Hostname,
+		User:             defaultUser,
+		UserPasswordHash: defaultUserPasswordHash,
+		AuthorizedKeys:   authorizedKeys,
+		WifiSSID:         args.WifiSSID,
+		WifiPass:         args.WifiPass,
+		WifiCountry:      args.WifiCountry,
+		Timezone:         args.Timezone,
+		Locale:           args.Locale,
+		Keymap:           args.Keymap,
+		Interfaces:       networkInterfaces(args),
+		Hooks:            hooks,
+		HooksDir:         hooksDir,
+		FirstRunLog:      firstRunLog,
 	}
+}
 
-	tmpl, err := template.New("firstrun").Parse(firstRunTemplate)
-	if err != nil {
-		info.Fail()
-		return fmt.Errorf("error loading template: %w", err)
+// The lower the metric, the higher the priority
+func networkInterfaces(args BootArgs) []networkInterface {
+	interfaces := []networkInterface{{Name: "eth0", Metric: 100}}
+	if len(args.WifiSSID) > 0 && len(args.WifiPass) > 0 {
+		interfaces = append(interfaces, networkInterface{Name: "wlan0", Wifi: true, Metric: 200})
 	}
 
-	var buffer bytes.Buffer
-	err = tmpl.Execute(&buffer, firstRunScriptData{
-		Hostname:    hostname,
-		WifiSSID:    wifiSSID,
-		WifiPass:    wifiPass,
-		WifiCountry: country,
-	})
+	if args.StaticIP != nil {
+		dns := []string{}
+		for _, ip := range args.StaticIP.DNS {
+			dns = append(dns, ip.String())
+		}
+		// The same address in two interfaces of the same subnet would break
+		// the routing, so it is only applied to one of them
+		for i := range interfaces {
+			if interfaces[i].Name != args.StaticIP.Interface {
+				continue
+			}
+			interfaces[i].Address = args.StaticIP.Address.String()
+			interfaces[i].Gateway = args.StaticIP.Gateway.String()
+			interfaces[i].DNS = dns
+		}
+	}
+
+	// The usb0 interface only connects the raspberry with the computer, so it
+	// doesn't have gateway nor DNS
+	if args.UsbGadget {
+		address := args.UsbGadgetIP
+		if address == nil {
+			address = DefaultUsbGadgetIP
+		}
+		interfaces = append(interfaces, networkInterface{Name: "usb0", Address: address.String(), Metric: 300})
+	}
+	return interfaces
+}
+
+func (b BootManager) firstRunScript(args BootArgs, data templateData) error {
+	info.Title("Setting up first run script")
+
+	content, err := b.loadFirstRunTemplate(args.Template)
 	if err != nil {
 		info.Fail()
-		return fmt.Errorf("error parsing template: %w", err)
+		return err
 	}
 
-	fileBytes := buffer.Bytes()
-	if len(fileBytes) == 0 {
+	fileBytes, err := renderTemplate("firstrun", content, data)
+	if err != nil {
 		info.Fail()
-		return fmt.Errorf("rendered script is empty")
+		return err
 	}
 
-	err = os.WriteFile(filepath.Join(bootPath, "firstrun.sh"), fileBytes, 0)
+	err = os.WriteFile(filepath.Join(args.BootPath, "firstrun.sh"), fileBytes, 0)
 	if err != nil {
 		info.Fail()
 		return fmt.Errorf("error writing first run script: %w", err)
@@ -109,45 +290,53 @@ func (b BootManager) firstRunScript(bootPath, hostname, wifiSSID, wifiPass, coun
 	return nil
 }
 
+func renderTemplate(name, content string, data any) ([]byte, error) {
+	tmpl, err := template.New(name).Funcs(template.FuncMap{
+		"quote": yamlQuote,
+		"join":  strings.Join,
+	}).Parse(content)
+	if err != nil {
+		return nil, fmt.Errorf("error loading template: %w", err)
+	}
+
+	var buffer bytes.Buffer
+	err = tmpl.Execute(&buffer, data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing template: %w", err)
+	}
+
+	fileBytes := buffer.Bytes()
+	if len(fileBytes) == 0 {
+		return nil, fmt.Errorf("rendered %s is empty", name)
+	}
+	return fileBytes, nil
+}
+
 func (b BootManager) updateCmdArgs(bootPath string) error {
 	info.Title("Enabling firstrun script")
 
 	cmdLinePath := filepath.Join(bootPath, "cmdline.txt")
-	content, err := os.ReadFile(cmdLinePath)
+	cmdLine, err := ReadCmdLine(cmdLinePath)
 	if err != nil {
 		info.Fail()
-		return fmt.Errorf("error reading cmdline.txt: %w", err)
+		return err
 	}
 
-	cmdArgs := strings.Split(strings.Trim(string(content), "\n"), " ")
-	cmdArgs = append(cmdArgs,
-		"systemd.run=/boot/firstrun.sh",
-		"systemd.run_success_action=reboot",
-		"systemd.unit=kernel-command-line.target")
-
-	cmdArgs = removeDuplicates(cmdArgs)
-	sort.StringSlice(cmdArgs).Sort()
+	// The firstrun script removes everything after systemd.run, so these
+	// parameters must be the last ones
+	for _, key := range []string{"systemd.run", "systemd.run_success_action", "systemd.unit"} {
+		cmdLine.Remove(key)
+	}
+	cmdLine.Set("systemd.run", "/boot/firstrun.sh")
+	cmdLine.Set("systemd.run_success_action", "reboot")
+	cmdLine.Set("systemd.unit", "kernel-command-line.target")
 
-	newContent := strings.Join(cmdArgs, " ") + "\n"
-	err = os.WriteFile(cmdLinePath, []byte(newContent), 0)
+	err = cmdLine.Write(cmdLinePath)
 	if err != nil {
 		info.Fail()
-		return fmt.Errorf("error writing cmdline.txt: %w", err)
+		return err
 	}
 
 	info.Ok()
 	return nil
 }
-
-func removeDuplicates[T comparable](slice []T) []T {
-	seen := make(map[T]bool)
-	result := []T{}
-
-	for _, val := range slice {
-		if _, ok := seen[val]; !ok {
-			seen[val] = true
-			result = append(result, val)
-		}
-	}
-	return result
-}
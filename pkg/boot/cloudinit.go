@@ -0,0 +1,73 @@
+package boot
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+)
+
+//go:embed user-data.tmpl
+var userDataTemplate string
+
+//go:embed network-config.tmpl
+var networkConfigTemplate string
+
+//go:embed meta-data.tmpl
+var metaDataTemplate string
+
+// Files read by cloud-init from the boot partition (NoCloud datasource)
+var cloudInitFiles = []string{"user-data", "network-config", "meta-data"}
+
+// IsCloudInit returns true if the image in bootPath is provisioned with
+// cloud-init instead of the firstrun.sh script.
+func IsCloudInit(bootPath string) bool {
+	for _, name := range []string{"user-data", "network-config"} {
+		if _, err := os.Stat(filepath.Join(bootPath, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (b BootManager) cloudInit(bootPath string, data templateData) error {
+	info.Title("Setting up cloud-init")
+
+	templates := map[string]string{
+		"user-data":      userDataTemplate,
+		"network-config": networkConfigTemplate,
+		"meta-data":      metaDataTemplate,
+	}
+
+	for _, name := range cloudInitFiles {
+		fileBytes, err := renderTemplate(name, templates[name], data)
+		if err != nil {
+			info.Fail()
+			return err
+		}
+
+		err = os.WriteFile(filepath.Join(bootPath, name), fileBytes, 0644)
+		if err != nil {
+			info.Fail()
+			return fmt.Errorf("error writing %s: %w", name, err)
+		}
+	}
+
+	info.Ok()
+	return nil
+}
+
+// yamlQuote returns s as a double quoted YAML scalar. JSON strings are valid
+// YAML, so the JSON encoder takes care of the escaping.
+func yamlQuote(s string) string {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+	return strings.TrimSuffix(buffer.String(), "\n")
+}
@@ -0,0 +1,210 @@
+package boot
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CmdLine is the list of kernel parameters of cmdline.txt. The order of the
+// parameters is preserved, as it matters for some of them (like console=).
+type CmdLine struct {
+	params []cmdLineParam
+}
+
+type cmdLineParam struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+func (p cmdLineParam) String() string {
+	if !p.hasValue {
+		return p.key
+	}
+	return p.key + "=" + p.value
+}
+
+func ParseCmdLine(content string) *CmdLine {
+	c := &CmdLine{}
+	for _, arg := range splitCmdLine(content) {
+		key, value, hasValue := strings.Cut(arg, "=")
+		c.params = append(c.params, cmdLineParam{key: key, value: value, hasValue: hasValue})
+	}
+	return c
+}
+
+func ReadCmdLine(path string) (*CmdLine, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cmdline.txt: %w", err)
+	}
+	return ParseCmdLine(string(content)), nil
+}
+
+// Write saves the parameters in a single line, as required by the bootloader
+func (c *CmdLine) Write(path string) error {
+	err := os.WriteFile(path, []byte(c.String()+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing cmdline.txt: %w", err)
+	}
+	return nil
+}
+
+func (c *CmdLine) String() string {
+	return strings.Join(c.Args(), " ")
+}
+
+// Args returns the parameters in order, formatted as key=value
+func (c *CmdLine) Args() []string {
+	args := []string{}
+	for _, param := range c.params {
+		args = append(args, param.String())
+	}
+	return args
+}
+
+func (c *CmdLine) Has(key string) bool {
+	return c.index(key) != -1
+}
+
+// Get returns the value of the first occurrence of key
+func (c *CmdLine) Get(key string) (string, bool) {
+	i := c.index(key)
+	if i == -1 {
+		return "", false
+	}
+	return c.params[i].value, true
+}
+
+// Values returns the values of every occurrence of key (e.g. console=)
+func (c *CmdLine) Values(key string) []string {
+	values := []string{}
+	for _, param := range c.params {
+		if param.key == key {
+			values = append(values, param.value)
+		}
+	}
+	return values
+}
+
+// Set replaces the value of key in its current position, removing any other
+// occurrence. If the key is not present, it is appended.
+func (c *CmdLine) Set(key, value string) {
+	c.set(cmdLineParam{key: key, value: value, hasValue: true})
+}
+
+// SetAfter works like Set, but a new key is inserted after the first
+// occurrence of after (or appended if after is not present)
+func (c *CmdLine) SetAfter(key, value, after string) {
+	if c.Has(key) {
+		c.Set(key, value)
+		return
+	}
+	i := c.index(after)
+	if i == -1 {
+		c.Set(key, value)
+		return
+	}
+	param := cmdLineParam{key: key, value: value, hasValue: true}
+	c.params = append(c.params[:i+1], append([]cmdLineParam{param}, c.params[i+1:]...)...)
+}
+
+// SetFlag adds a parameter without value (e.g. quiet)
+func (c *CmdLine) SetFlag(key string) {
+	c.set(cmdLineParam{key: key})
+}
+
+func (c *CmdLine) set(param cmdLineParam) {
+	i := c.index(param.key)
+	if i == -1 {
+		c.params = append(c.params, param)
+		return
+	}
+	c.params[i] = param
+	c.params = append(c.params[:i+1], withoutParam(c.params[i+1:], param.key, nil)...)
+}
+
+// Add appends a repeated key (e.g. console=) unless the same key and value
+// are already present
+func (c *CmdLine) Add(key, value string) {
+	for _, param := range c.params {
+		if param.key == key && param.hasValue && param.value == value {
+			return
+		}
+	}
+	c.params = append(c.params, cmdLineParam{key: key, value: value, hasValue: true})
+}
+
+// AddBefore works like Add, but the parameter is inserted before the first
+// occurrence of before (or appended if before is not present)
+func (c *CmdLine) AddBefore(key, value, before string) {
+	for _, param := range c.params {
+		if param.key == key && param.hasValue && param.value == value {
+			return
+		}
+	}
+	i := c.index(before)
+	if i == -1 {
+		c.Add(key, value)
+		return
+	}
+	param := cmdLineParam{key: key, value: value, hasValue: true}
+	c.params = append(c.params[:i], append([]cmdLineParam{param}, c.params[i:]...)...)
+}
+
+// Remove deletes every occurrence of key
+func (c *CmdLine) Remove(key string) {
+	c.params = withoutParam(c.params, key, nil)
+}
+
+// RemoveValue deletes the occurrences of key with the given value
+func (c *CmdLine) RemoveValue(key, value string) {
+	c.params = withoutParam(c.params, key, &value)
+}
+
+func withoutParam(params []cmdLineParam, key string, value *string) []cmdLineParam {
+	result := []cmdLineParam{}
+	for _, param := range params {
+		if param.key == key && (value == nil || param.value == *value) {
+			continue
+		}
+		result = append(result, param)
+	}
+	return result
+}
+
+func (c *CmdLine) index(key string) int {
+	for i, param := range c.params {
+		if param.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// splitCmdLine splits the parameters by whitespace, keeping double quoted
+// values (e.g. dyndbg="file foo.c +p") together
+func splitCmdLine(content string) []string {
+	args := []string{}
+	var current strings.Builder
+	quoted := false
+	for _, r := range content {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\n' || r == '\r'):
+			if current.Len() > 0 {
+				args = append(args, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		args = append(args, current.String())
+	}
+	return args
+}
@@ -0,0 +1,168 @@
+package boot
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCmdLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmdLine  string
+		edit     func(c *CmdLine)
+		expected string
+	}{
+		{
+			name:     "set replaces in place",
+			cmdLine:  "console=tty1 root=PARTUUID=1 rootwait",
+			edit:     func(c *CmdLine) { c.Set("root", "PARTUUID=2") },
+			expected: "console=tty1 root=PARTUUID=2 rootwait",
+		},
+		{
+			name:     "set removes other occurrences",
+			cmdLine:  "quiet root=a splash root=b",
+			edit:     func(c *CmdLine) { c.Set("root", "c") },
+			expected: "quiet root=c splash",
+		},
+		{
+			name:     "set appends a new key",
+			cmdLine:  "console=tty1 rootwait",
+			edit:     func(c *CmdLine) { c.Set("fsck.repair", "yes") },
+			expected: "console=tty1 rootwait fsck.repair=yes",
+		},
+		{
+			name:     "set flag",
+			cmdLine:  "console=tty1 quiet",
+			edit:     func(c *CmdLine) { c.SetFlag("quiet"); c.SetFlag("splash") },
+			expected: "console=tty1 quiet splash",
+		},
+		{
+			name:     "set after inserts after the key",
+			cmdLine:  "console=tty1 rootwait quiet",
+			edit:     func(c *CmdLine) { c.SetAfter("modules-load", "dwc2,g_ether", "rootwait") },
+			expected: "console=tty1 rootwait modules-load=dwc2,g_ether quiet",
+		},
+		{
+			name:     "set after keeps the position of an existing key",
+			cmdLine:  "modules-load=dwc2 console=tty1 rootwait",
+			edit:     func(c *CmdLine) { c.SetAfter("modules-load", "dwc2,g_ether", "rootwait") },
+			expected: "modules-load=dwc2,g_ether console=tty1 rootwait",
+		},
+		{
+			name:     "set after appends without the key",
+			cmdLine:  "console=tty1 quiet",
+			edit:     func(c *CmdLine) { c.SetAfter("modules-load", "dwc2,g_ether", "rootwait") },
+			expected: "console=tty1 quiet modules-load=dwc2,g_ether",
+		},
+		{
+			name:     "add keeps repeated keys",
+			cmdLine:  "console=serial0,115200",
+			edit:     func(c *CmdLine) { c.Add("console", "tty1"); c.Add("console", "tty1") },
+			expected: "console=serial0,115200 console=tty1",
+		},
+		{
+			name:     "add before inserts before the first occurrence",
+			cmdLine:  "root=a console=tty1 console=tty2",
+			edit:     func(c *CmdLine) { c.AddBefore("console", "serial0,115200", "console") },
+			expected: "root=a console=serial0,115200 console=tty1 console=tty2",
+		},
+		{
+			name:     "add before skips an existing value",
+			cmdLine:  "console=tty1 console=serial0,115200",
+			edit:     func(c *CmdLine) { c.AddBefore("console", "serial0,115200", "console") },
+			expected: "console=tty1 console=serial0,115200",
+		},
+		{
+			name:     "add before appends without the key",
+			cmdLine:  "root=a rootwait",
+			edit:     func(c *CmdLine) { c.AddBefore("console", "serial0,115200", "console") },
+			expected: "root=a rootwait console=serial0,115200",
+		},
+		{
+			name:     "remove every occurrence",
+			cmdLine:  "console=serial0,115200 root=a console=tty1",
+			edit:     func(c *CmdLine) { c.Remove("console") },
+			expected: "root=a",
+		},
+		{
+			name:     "remove value",
+			cmdLine:  "console=serial0,115200 root=a console=tty1",
+			edit:     func(c *CmdLine) { c.RemoveValue("console", "serial0,115200") },
+			expected: "root=a console=tty1",
+		},
+		{
+			name:     "quoted values",
+			cmdLine:  "root=a dyndbg=\"file foo.c +p\"  quiet\n",
+			edit:     func(c *CmdLine) { c.Set("root", "b") },
+			expected: "root=b dyndbg=\"file foo.c +p\" quiet",
+		},
+		{
+			name:     "values with equal signs",
+			cmdLine:  "root=PARTUUID=1 quiet",
+			edit:     func(c *CmdLine) {},
+			expected: "root=PARTUUID=1 quiet",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := ParseCmdLine(test.cmdLine)
+			test.edit(c)
+			if got := c.String(); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestCmdLineGet(t *testing.T) {
+	c := ParseCmdLine("console=serial0,115200 root=PARTUUID=1 console=tty1 quiet")
+
+	if value, ok := c.Get("root"); !ok || value != "PARTUUID=1" {
+		t.Errorf("expected root=PARTUUID=1, got %q (%v)", value, ok)
+	}
+	if _, ok := c.Get("splash"); ok {
+		t.Error("found a missing key")
+	}
+	if !c.Has("quiet") {
+		t.Error("flag not found")
+	}
+	if values := c.Values("console"); !slices.Equal(values, []string{"serial0,115200", "tty1"}) {
+		t.Errorf("unexpected console values: %v", values)
+	}
+}
+
+// The firstrun script removes " systemd.run.*" from cmdline.txt, so the
+// parameters added by the boot setup must go before systemd.run
+func TestSetupKeepsSystemdRunLast(t *testing.T) {
+	bootPath := t.TempDir()
+	cmdLinePath := filepath.Join(bootPath, "cmdline.txt")
+	if err := os.WriteFile(cmdLinePath, []byte("root=PARTUUID=1 fsck.repair=yes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bootPath, "config.txt"), []byte("[all]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := BootArgs{BootPath: bootPath, Hostname: "test", UsbGadget: true, SerialConsole: true, UsbGadgetIP: DefaultUsbGadgetIP}
+	if err := NewBootManager().Setup(args); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ReadCmdLine(cmdLinePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstBoot, _, found := strings.Cut(c.String(), " systemd.run")
+	if !found {
+		t.Fatalf("systemd.run not found in %q", c.String())
+	}
+	for _, arg := range []string{"modules-load=dwc2,g_ether", "console=serial0,115200"} {
+		if !slices.Contains(strings.Fields(firstBoot), arg) {
+			t.Errorf("%s is removed by the firstrun script: %q", arg, c.String())
+		}
+	}
+}
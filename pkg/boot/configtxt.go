@@ -0,0 +1,177 @@
+package boot
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConfigTxt is the firmware configuration (config.txt). Lines are kept as they
+// are, so comments and unknown settings survive the changes. Settings belong to
+// the section opened by the last conditional filter ([all], [pi4], ...), being
+// [all] the section of the lines before the first filter.
+type ConfigTxt struct {
+	lines []configLine
+}
+
+type configLine struct {
+	raw     string
+	section string
+	// Identifies the setting, empty for comments, blank lines and filters.
+	// Overlays and params can be repeated, so the name of the overlay or param
+	// is part of the id (e.g. dtoverlay:dwc2, dtparam:i2c_arm).
+	id string
+}
+
+func ParseConfigTxt(content string) *ConfigTxt {
+	c := &ConfigTxt{}
+	section := "all"
+	for _, line := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]") {
+			section = strings.Trim(trimmed, "[]")
+			c.lines = append(c.lines, configLine{raw: line, section: section})
+			continue
+		}
+		c.lines = append(c.lines, configLine{raw: line, section: section, id: configLineId(trimmed)})
+	}
+	return c
+}
+
+func ReadConfigTxt(path string) (*ConfigTxt, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading config.txt: %w", err)
+	}
+	return ParseConfigTxt(string(content)), nil
+}
+
+func (c *ConfigTxt) Write(path string) error {
+	err := os.WriteFile(path, []byte(c.String()), 0644)
+	if err != nil {
+		return fmt.Errorf("error writing config.txt: %w", err)
+	}
+	return nil
+}
+
+func (c *ConfigTxt) String() string {
+	lines := []string{}
+	for _, line := range c.lines {
+		lines = append(lines, line.raw)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Get returns the value of key in section
+func (c *ConfigTxt) Get(section, key string) (string, bool) {
+	for _, line := range c.lines {
+		if line.section == section && line.id == key {
+			_, value, _ := strings.Cut(line.raw, "=")
+			return strings.TrimSpace(value), true
+		}
+	}
+	return "", false
+}
+
+// Set sets key=value in section (e.g. Set("all", "gpu_mem", "128"))
+func (c *ConfigTxt) Set(section, key, value string) {
+	c.setLine(section, key, fmt.Sprintf("%s=%s", key, value))
+}
+
+func (c *ConfigTxt) Remove(section, key string) {
+	c.removeLines(section, key)
+}
+
+// SetParam sets a device tree parameter (e.g. SetParam("all", "spi", "on"))
+func (c *ConfigTxt) SetParam(section, name, value string) {
+	c.setLine(section, "dtparam:"+name, fmt.Sprintf("dtparam=%s=%s", name, value))
+}
+
+func (c *ConfigTxt) RemoveParam(section, name string) {
+	c.removeLines(section, "dtparam:"+name)
+}
+
+// SetOverlay adds a device tree overlay with its params (e.g. "dwc2" or
+// "gpio-fan,gpiopin=14"), replacing the existing one with the same name
+func (c *ConfigTxt) SetOverlay(section, overlay string) {
+	name, _, _ := strings.Cut(overlay, ",")
+	c.setLine(section, "dtoverlay:"+name, "dtoverlay="+overlay)
+}
+
+func (c *ConfigTxt) RemoveOverlay(section, name string) {
+	c.removeLines(section, "dtoverlay:"+name)
+}
+
+// setLine replaces the first line with the given id in section, removing the
+// rest. If there is no such line, it is added at the end of the section.
+func (c *ConfigTxt) setLine(section, id, raw string) {
+	found := false
+	lines := []configLine{}
+	for _, line := range c.lines {
+		if line.section == section && line.id == id {
+			if !found {
+				lines = append(lines, configLine{raw: raw, section: section, id: id})
+				found = true
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	c.lines = lines
+	if found {
+		return
+	}
+
+	newLine := configLine{raw: raw, section: section, id: id}
+	last := c.lastLine(section)
+	if last == -1 {
+		c.lines = append(c.lines, configLine{raw: ""})
+		c.lines = append(c.lines, configLine{raw: fmt.Sprintf("[%s]", section), section: section})
+		c.lines = append(c.lines, newLine)
+		return
+	}
+	c.lines = append(c.lines[:last+1], append([]configLine{newLine}, c.lines[last+1:]...)...)
+}
+
+func (c *ConfigTxt) removeLines(section, id string) {
+	lines := []configLine{}
+	for _, line := range c.lines {
+		if line.section == section && line.id == id {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	c.lines = lines
+}
+
+// lastLine returns the index of the last non blank line of the last block of
+// section, -1 if the section does not exist
+func (c *ConfigTxt) lastLine(section string) int {
+	last := -1
+	for i, line := range c.lines {
+		if line.section != section {
+			continue
+		}
+		if strings.TrimSpace(line.raw) != "" || last == -1 {
+			last = i
+		}
+	}
+	return last
+}
+
+func configLineId(line string) string {
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ""
+	}
+	key, value, found := strings.Cut(line, "=")
+	if !found {
+		return ""
+	}
+	key = strings.TrimSpace(key)
+	if key == "dtoverlay" || key == "dtparam" {
+		name, _, _ := strings.Cut(strings.TrimSpace(value), ",")
+		name, _, _ = strings.Cut(name, "=")
+		return key + ":" + name
+	}
+	return key
+}
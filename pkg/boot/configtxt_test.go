@@ -0,0 +1,120 @@
+package boot
+
+import "testing"
+
+func TestConfigTxt(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		edit     func(c *ConfigTxt)
+		expected string
+	}{
+		{
+			name:     "replace an existing key",
+			config:   "# comment\ngpu_mem=64\narm_boost=1\n",
+			edit:     func(c *ConfigTxt) { c.Set("all", "gpu_mem", "128") },
+			expected: "# comment\ngpu_mem=128\narm_boost=1\n",
+		},
+		{
+			name:     "replace removes duplicates",
+			config:   "gpu_mem=64\narm_boost=1\ngpu_mem=32\n",
+			edit:     func(c *ConfigTxt) { c.Set("all", "gpu_mem", "128") },
+			expected: "gpu_mem=128\narm_boost=1\n",
+		},
+		{
+			name:     "append to the implicit all section",
+			config:   "arm_boost=1\n\n[pi4]\ngpu_mem=64\n",
+			edit:     func(c *ConfigTxt) { c.Set("all", "gpu_mem", "128") },
+			expected: "arm_boost=1\ngpu_mem=128\n\n[pi4]\ngpu_mem=64\n",
+		},
+		{
+			name:     "key inside a conditional section",
+			config:   "gpu_mem=64\n\n[pi4]\ngpu_mem=256\n\n[all]\narm_boost=1\n",
+			edit:     func(c *ConfigTxt) { c.Set("pi4", "gpu_mem", "128") },
+			expected: "gpu_mem=64\n\n[pi4]\ngpu_mem=128\n\n[all]\narm_boost=1\n",
+		},
+		{
+			name:     "append to the last all section",
+			config:   "gpu_mem=64\n\n[pi4]\narm_boost=1\n\n[all]\nenable_uart=0\n",
+			edit:     func(c *ConfigTxt) { c.Set("all", "enable_uart", "1"); c.Set("all", "disable_splash", "1") },
+			expected: "gpu_mem=64\n\n[pi4]\narm_boost=1\n\n[all]\nenable_uart=1\ndisable_splash=1\n",
+		},
+		{
+			name:     "key of another section is not replaced",
+			config:   "[pi4]\nenable_uart=0\n",
+			edit:     func(c *ConfigTxt) { c.Set("all", "enable_uart", "1") },
+			expected: "[pi4]\nenable_uart=0\n\n[all]\nenable_uart=1\n",
+		},
+		{
+			name:     "add a missing section",
+			config:   "gpu_mem=64\n",
+			edit:     func(c *ConfigTxt) { c.Set("pi5", "arm_boost", "1") },
+			expected: "gpu_mem=64\n\n[pi5]\narm_boost=1\n",
+		},
+		{
+			name:     "spaces around the equal sign",
+			config:   "gpu_mem = 64\n",
+			edit:     func(c *ConfigTxt) { c.Set("all", "gpu_mem", "128") },
+			expected: "gpu_mem=128\n",
+		},
+		{
+			name:     "commented keys are kept",
+			config:   "#dtparam=spi=on\n",
+			edit:     func(c *ConfigTxt) { c.SetParam("all", "spi", "on") },
+			expected: "#dtparam=spi=on\ndtparam=spi=on\n",
+		},
+		{
+			name:     "replace a param by name",
+			config:   "dtparam=audio=on\ndtparam=spi=off\n",
+			edit:     func(c *ConfigTxt) { c.SetParam("all", "spi", "on") },
+			expected: "dtparam=audio=on\ndtparam=spi=on\n",
+		},
+		{
+			name:     "replace an overlay by name",
+			config:   "[pi4]\ndtoverlay=vc4-kms-v3d\ndtoverlay=gpio-fan,gpiopin=14\n",
+			edit:     func(c *ConfigTxt) { c.SetOverlay("pi4", "gpio-fan,gpiopin=18,temp=60000") },
+			expected: "[pi4]\ndtoverlay=vc4-kms-v3d\ndtoverlay=gpio-fan,gpiopin=18,temp=60000\n",
+		},
+		{
+			name:     "remove only in the section",
+			config:   "dtoverlay=dwc2\n\n[pi4]\ndtoverlay=dwc2\n",
+			edit:     func(c *ConfigTxt) { c.RemoveOverlay("pi4", "dwc2") },
+			expected: "dtoverlay=dwc2\n\n[pi4]\n",
+		},
+		{
+			name:     "remove keys and params",
+			config:   "gpu_mem=64\ndtparam=spi=on\narm_boost=1\n",
+			edit:     func(c *ConfigTxt) { c.Remove("all", "gpu_mem"); c.RemoveParam("all", "spi") },
+			expected: "arm_boost=1\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := ParseConfigTxt(test.config)
+			test.edit(c)
+			if got := c.String(); got != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestConfigTxtGet(t *testing.T) {
+	c := ParseConfigTxt("gpu_mem=64\n\n[pi4]\ngpu_mem = 256\n")
+	tests := []struct {
+		section  string
+		expected string
+		found    bool
+	}{
+		{"all", "64", true},
+		{"pi4", "256", true},
+		{"pi5", "", false},
+	}
+	for _, test := range tests {
+		value, found := c.Get(test.section, "gpu_mem")
+		if value != test.expected || found != test.found {
+			t.Errorf("[%s] expected %q (%v), got %q (%v)", test.section, test.expected, test.found, value, found)
+		}
+	}
+}
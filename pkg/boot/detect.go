@@ -0,0 +1,194 @@
+package boot
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+type BootPartition struct {
+	Path string
+	// Block device of the partition, empty if unknown
+	Device string
+}
+
+func (p BootPartition) String() string {
+	if len(p.Device) == 0 {
+		return p.Path
+	}
+	return fmt.Sprintf("%s (%s)", p.Path, p.Device)
+}
+
+// FindBootPartitions scans the mounted filesystems looking for Raspberry Pi
+// boot partitions (FAT volumes containing cmdline.txt and start*.elf). When
+// running on a Raspberry Pi, the partitions of the disk holding the running
+// system are ignored, so its own /boot/firmware is never modified.
+func FindBootPartitions() ([]BootPartition, error) {
+	candidates, err := mountedFATVolumes()
+	if err != nil {
+		return nil, err
+	}
+
+	if runtime.GOOS == "windows" {
+		// The filesystem type of the drives is not checked on windows
+		for letter := 'C'; letter <= 'Z'; letter++ {
+			candidates = append(candidates, BootPartition{Path: fmt.Sprintf("%c:\\", letter)})
+		}
+	}
+
+	seen := map[string]bool{}
+	result := []BootPartition{}
+	for _, candidate := range candidates {
+		path := filepath.Clean(candidate.Path)
+		if seen[path] || !IsBootPartition(path) {
+			continue
+		}
+		seen[path] = true
+		result = append(result, candidate)
+	}
+	return result, nil
+}
+
+func IsBootPartition(path string) bool {
+	if !fileExists(filepath.Join(path, "cmdline.txt")) {
+		return false
+	}
+	firmware, _ := filepath.Glob(filepath.Join(path, "start*.elf"))
+	return len(firmware) > 0
+}
+
+func isFAT(fsType string) bool {
+	switch fsType {
+	case "vfat", "msdos", "fat", "exfat":
+		return true
+	}
+	return false
+}
+
+// mountedFATVolumes returns the mounted FAT volumes, read from
+// /proc/self/mountinfo on linux and from the output of mount on macOS.
+func mountedFATVolumes() ([]BootPartition, error) {
+	if runtime.GOOS == "darwin" {
+		return mountedFATVolumesDarwin()
+	}
+
+	file, err := os.Open("/proc/self/mountinfo")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading mounted filesystems: %w", err)
+	}
+	defer file.Close()
+
+	type mount struct {
+		partition BootPartition
+		devNumber string
+		fsType    string
+	}
+
+	// Format: id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+	mounts := []mount{}
+	systemDevNumber := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		separator := -1
+		for i, field := range fields {
+			if field == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator < 5 || len(fields) < separator+3 {
+			continue
+		}
+
+		mountPoint := unescapeMountPath(fields[4])
+		if mountPoint == "/" {
+			systemDevNumber = fields[2]
+		}
+		mounts = append(mounts, mount{
+			partition: BootPartition{Path: mountPoint, Device: fields[separator+2]},
+			devNumber: fields[2],
+			fsType:    fields[separator+1],
+		})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading mounted filesystems: %w", err)
+	}
+
+	systemDisk := diskOf(systemDevNumber)
+	result := []BootPartition{}
+	for _, m := range mounts {
+		if !isFAT(m.fsType) {
+			continue
+		}
+		if len(systemDisk) != 0 && diskOf(m.devNumber) == systemDisk {
+			continue
+		}
+		result = append(result, m.partition)
+	}
+	return result, nil
+}
+
+// diskOf returns the name of the disk containing the block device identified
+// by major:minor (e.g. mmcblk0 for mmcblk0p1), or an empty string if it is not
+// a block device.
+func diskOf(devNumber string) string {
+	if len(devNumber) == 0 {
+		return ""
+	}
+	sysPath, err := filepath.EvalSymlinks(filepath.Join("/sys/dev/block", devNumber))
+	if err != nil {
+		return ""
+	}
+	if fileExists(filepath.Join(sysPath, "partition")) {
+		return filepath.Base(filepath.Dir(sysPath))
+	}
+	return filepath.Base(sysPath)
+}
+
+var darwinMountRegex = regexp.MustCompile(`^(\S+) on (.+) \((\w+)`)
+
+// mountedFATVolumesDarwin parses the output of mount, whose lines look like
+// "/dev/disk4s1 on /Volumes/bootfs (msdos, local, nodev, nosuid, noowners)".
+// The system disk of a mac is never FAT, so it doesn't need to be excluded.
+func mountedFATVolumesDarwin() ([]BootPartition, error) {
+	output, err := exec.Command("mount").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error reading mounted filesystems: %w", err)
+	}
+
+	result := []BootPartition{}
+	for _, line := range strings.Split(string(output), "\n") {
+		match := darwinMountRegex.FindStringSubmatch(line)
+		if match == nil || !isFAT(match[3]) {
+			continue
+		}
+		result = append(result, BootPartition{Path: match[2], Device: match[1]})
+	}
+	return result, nil
+}
+
+// unescapeMountPath decodes the octal escapes of /proc/mounts (e.g. \040 for spaces)
+func unescapeMountPath(path string) string {
+	var builder strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if value, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				builder.WriteByte(byte(value))
+				i += 3
+				continue
+			}
+		}
+		builder.WriteByte(path[i])
+	}
+	return builder.String()
+}
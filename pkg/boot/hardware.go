@@ -0,0 +1,147 @@
+package boot
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+)
+
+// HardwareArgs are the changes applied to config.txt
+type HardwareArgs struct {
+	// Conditional filter of config.txt where settings are written (all, pi4, ...)
+	Section        string
+	Enable         []string
+	Disable        []string
+	GpuMem         int
+	Overlays       []string
+	RemoveOverlays []string
+	// Raw settings (key=value)
+	Set   []string
+	Unset []string
+}
+
+type hardwareInterface struct {
+	key      string
+	param    bool
+	enabled  string
+	disabled string
+}
+
+// Interfaces that can be passed to HardwareArgs.Enable and HardwareArgs.Disable
+var hardwareInterfaces = map[string]hardwareInterface{
+	"i2c":    {key: "i2c_arm", param: true, enabled: "on", disabled: "off"},
+	"spi":    {key: "spi", param: true, enabled: "on", disabled: "off"},
+	"uart":   {key: "enable_uart", enabled: "1", disabled: "0"},
+	"camera": {key: "camera_auto_detect", enabled: "1", disabled: "0"},
+}
+
+func HardwareInterfaces() []string {
+	return []string{"i2c", "spi", "uart", "camera"}
+}
+
+func (h HardwareArgs) IsEmpty() bool {
+	return len(h.Enable) == 0 && len(h.Disable) == 0 && h.GpuMem == 0 &&
+		len(h.Overlays) == 0 && len(h.RemoveOverlays) == 0 &&
+		len(h.Set) == 0 && len(h.Unset) == 0
+}
+
+func (h HardwareArgs) Validate() error {
+	for _, name := range append(append([]string{}, h.Enable...), h.Disable...) {
+		if _, ok := hardwareInterfaces[name]; !ok {
+			return fmt.Errorf("unknown interface '%s' (valid interfaces: %s)",
+				name, strings.Join(HardwareInterfaces(), ", "))
+		}
+	}
+	for _, setting := range h.Set {
+		if !strings.Contains(setting, "=") {
+			return fmt.Errorf("invalid setting '%s', must match key=value", setting)
+		}
+	}
+	if h.GpuMem < 0 {
+		return fmt.Errorf("invalid gpu memory: %d", h.GpuMem)
+	}
+	return nil
+}
+
+// Apply makes the changes to config and returns true if it was modified
+func (h HardwareArgs) Apply(config *ConfigTxt) (bool, error) {
+	if err := h.Validate(); err != nil {
+		return false, err
+	}
+
+	section := h.Section
+	if section == "" {
+		section = "all"
+	}
+	initial := config.String()
+
+	for _, name := range h.Enable {
+		h.setInterface(config, section, hardwareInterfaces[name], true)
+	}
+	for _, name := range h.Disable {
+		h.setInterface(config, section, hardwareInterfaces[name], false)
+	}
+	if h.GpuMem > 0 {
+		config.Set(section, "gpu_mem", strconv.Itoa(h.GpuMem))
+	}
+	for _, overlay := range h.Overlays {
+		config.SetOverlay(section, overlay)
+	}
+	for _, name := range h.RemoveOverlays {
+		config.RemoveOverlay(section, name)
+	}
+	for _, setting := range h.Set {
+		key, value, _ := strings.Cut(setting, "=")
+		config.Set(section, strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	for _, key := range h.Unset {
+		config.Remove(section, key)
+	}
+
+	return config.String() != initial, nil
+}
+
+func (h HardwareArgs) setInterface(config *ConfigTxt, section string, iface hardwareInterface, enable bool) {
+	value := iface.disabled
+	if enable {
+		value = iface.enabled
+	}
+	if iface.param {
+		config.SetParam(section, iface.key, value)
+	} else {
+		config.Set(section, iface.key, value)
+	}
+}
+
+func (b BootManager) updateConfigTxt(bootPath string, args HardwareArgs) error {
+	info.Title("Updating config.txt")
+
+	configPath := filepath.Join(bootPath, "config.txt")
+	config, err := ReadConfigTxt(configPath)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	changed, err := args.Apply(config)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+	if !changed {
+		info.Skipped()
+		return nil
+	}
+
+	err = config.Write(configPath)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	info.Ok()
+	return nil
+}
@@ -0,0 +1,81 @@
+package boot
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+)
+
+// Directory in the boot partition where the hooks are copied. The hooks are
+// executed in order during the first boot and their output is saved in
+// firstRunLog, also in the boot partition.
+const (
+	hooksDir    = "firstrun-hooks"
+	firstRunLog = "firstrun.log"
+)
+
+// Hook names end up in shell commands of firstrun.sh and user-data, so they
+// are restricted to characters that don't need quoting.
+var hookNameRegex = regexp.MustCompile(`^[\w.+-]+$`)
+
+// copyHooks copies the hook scripts to the boot partition, prefixing them
+// with their position so they are executed in order. Returns the names of
+// the copied hooks.
+func (b BootManager) copyHooks(bootPath string, hooks []string) ([]string, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+
+	info.Title("Copying hooks")
+
+	for _, hook := range hooks {
+		if !hookNameRegex.MatchString(filepath.Base(hook)) {
+			info.Fail()
+			return nil, fmt.Errorf("invalid hook name %q: only letters, digits, '.', '_', '+' and '-' are allowed", filepath.Base(hook))
+		}
+	}
+
+	hooksPath := filepath.Join(bootPath, hooksDir)
+	err := os.RemoveAll(hooksPath)
+	if err != nil {
+		info.Fail()
+		return nil, fmt.Errorf("error removing old hooks: %w", err)
+	}
+	err = os.Mkdir(hooksPath, 0755)
+	if err != nil {
+		info.Fail()
+		return nil, fmt.Errorf("error creating hooks directory: %w", err)
+	}
+
+	names := []string{}
+	for i, hook := range hooks {
+		name := fmt.Sprintf("%02d-%s", i+1, filepath.Base(hook))
+		err = copyFile(hook, filepath.Join(hooksPath, name))
+		if err != nil {
+			info.Fail()
+			return nil, fmt.Errorf("error copying hook %s: %w", hook, err)
+		}
+		names = append(names, name)
+	}
+
+	info.Ok()
+	return names, nil
+}
+
+func (b BootManager) loadFirstRunTemplate(templatePath string) (string, error) {
+	if len(templatePath) == 0 {
+		if firstRunTemplate == "" {
+			return "", fmt.Errorf("embedded template is empty")
+		}
+		return firstRunTemplate, nil
+	}
+
+	content, err := os.ReadFile(templatePath)
+	if err != nil {
+		return "", fmt.Errorf("error reading template: %w", err)
+	}
+	return string(content), nil
+}
@@ -0,0 +1,151 @@
+package boot
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+	rpissh "github.com/sralloza/rpi-provisioner/pkg/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+const rsaHostKeyBits = 3072
+
+// hostKey is a SSH host key installed in /etc/ssh/ssh_host_<Type>_key, so
+// the first connection to the raspberry can be verified
+type hostKey struct {
+	Type string
+	// Private key in PEM format
+	Private string
+	// Public key in authorized_keys format
+	Public    string
+	publicKey ssh.PublicKey
+}
+
+func (b BootManager) generateHostKeys() ([]hostKey, error) {
+	info.Title("Generating ssh host keys")
+
+	ed25519Key, err := generateEd25519HostKey()
+	if err != nil {
+		info.Fail()
+		return nil, fmt.Errorf("error generating ed25519 host key: %w", err)
+	}
+
+	rsaKey, err := generateRSAHostKey()
+	if err != nil {
+		info.Fail()
+		return nil, fmt.Errorf("error generating rsa host key: %w", err)
+	}
+
+	info.Ok()
+	return []hostKey{ed25519Key, rsaKey}, nil
+}
+
+func generateEd25519HostKey() (hostKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return hostKey{}, err
+	}
+	block, err := marshalEd25519PrivateKey(private)
+	if err != nil {
+		return hostKey{}, err
+	}
+	return newHostKey("ed25519", block, public)
+}
+
+func generateRSAHostKey() (hostKey, error) {
+	private, err := rsa.GenerateKey(rand.Reader, rsaHostKeyBits)
+	if err != nil {
+		return hostKey{}, err
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)}
+	return newHostKey("rsa", block, &private.PublicKey)
+}
+
+func newHostKey(keyType string, block *pem.Block, public any) (hostKey, error) {
+	publicKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return hostKey{}, err
+	}
+	return hostKey{
+		Type:      keyType,
+		Private:   string(pem.EncodeToMemory(block)),
+		Public:    strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))),
+		publicKey: publicKey,
+	}, nil
+}
+
+// marshalEd25519PrivateKey encodes the key in the openssh-key-v1 format
+// (unencrypted), the only format supported by OpenSSH for ed25519 keys
+func marshalEd25519PrivateKey(key ed25519.PrivateKey) (*pem.Block, error) {
+	public := key.Public().(ed25519.PublicKey)
+	publicKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+
+	var check [4]byte
+	if _, err := rand.Read(check[:]); err != nil {
+		return nil, err
+	}
+
+	private := []byte{}
+	private = append(private, check[:]...)
+	private = append(private, check[:]...)
+	private = appendSSHString(private, []byte(ssh.KeyAlgoED25519))
+	private = appendSSHString(private, public)
+	private = appendSSHString(private, key)
+	private = appendSSHString(private, nil) // comment
+	for i := byte(1); len(private)%8 != 0; i++ {
+		private = append(private, i)
+	}
+
+	content := []byte("openssh-key-v1\x00")
+	content = appendSSHString(content, []byte("none")) // cipher
+	content = appendSSHString(content, []byte("none")) // kdf
+	content = appendSSHString(content, nil)            // kdf options
+	content = binary.BigEndian.AppendUint32(content, 1)
+	content = appendSSHString(content, publicKey.Marshal())
+	content = appendSSHString(content, private)
+
+	return &pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: content}, nil
+}
+
+func appendSSHString(buf, value []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(value)))
+	return append(buf, value...)
+}
+
+// addKnownHosts pins the host keys to the hostname (and its mDNS name) and
+// the static IPs of the raspberry
+func (b BootManager) addKnownHosts(args BootArgs, keys []hostKey) error {
+	info.Title("Adding host keys to known_hosts")
+
+	hosts := []string{args.Hostname, args.Hostname + ".local"}
+	for _, iface := range networkInterfaces(args) {
+		if ip, _, err := net.ParseCIDR(iface.Address); err == nil {
+			hosts = append(hosts, ip.String())
+		}
+	}
+
+	publicKeys := []ssh.PublicKey{}
+	for _, key := range keys {
+		publicKeys = append(publicKeys, key.publicKey)
+	}
+
+	err := rpissh.AddKnownHosts(hosts, publicKeys)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	info.Ok()
+	return nil
+}
@@ -0,0 +1,127 @@
+package boot
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type BootInspection struct {
+	SSHEnabled   bool
+	CloudInit    bool
+	FirstRun     bool
+	Hostname     string
+	User         string
+	WifiNetworks []string
+	SystemdArgs  []string
+	HasBackup    bool
+}
+
+var (
+	firstRunHostnameRegex = regexp.MustCompile(`set_hostname\s+'?([^'\s]+)'?`)
+	firstRunUserRegex     = regexp.MustCompile(`(?m)^NEW_FIRST_USER="?([^"\s]+)"?$|userconf\s+'([^']+)'`)
+	firstRunWifiRegex     = regexp.MustCompile(`set_wlan\s+(?:-h\s+)?'([^']*)'`)
+	wpaSSIDRegex          = regexp.MustCompile(`(?m)^\s*ssid="(.*)"$`)
+	userDataHostnameRegex = regexp.MustCompile(`(?m)^hostname:\s*(.+)$`)
+	userDataUserRegex     = regexp.MustCompile(`(?m)^\s+-\s+name:\s*(.+)$`)
+	accessPointRegex      = regexp.MustCompile(`(?m)^\s+access-points:\s*\n\s+(.+):\s*$`)
+)
+
+// Inspect reports the configuration found in the boot partition
+func (b BootManager) Inspect(bootPath string) (BootInspection, error) {
+	result := BootInspection{
+		SSHEnabled: fileExists(filepath.Join(bootPath, "ssh")) ||
+			fileExists(filepath.Join(bootPath, "ssh.txt")),
+		CloudInit: IsCloudInit(bootPath),
+		HasBackup: IsDirectory(filepath.Join(bootPath, backupDir)),
+	}
+
+	cmdLine, err := ReadCmdLine(filepath.Join(bootPath, "cmdline.txt"))
+	if err != nil {
+		return result, err
+	}
+	for _, arg := range cmdLine.Args() {
+		if strings.HasPrefix(arg, "systemd.") {
+			result.SystemdArgs = append(result.SystemdArgs, arg)
+		}
+	}
+
+	if firstRun, err := os.ReadFile(filepath.Join(bootPath, "firstrun.sh")); err == nil {
+		result.FirstRun = true
+		result.Hostname = firstSubmatch(firstRunHostnameRegex, string(firstRun))
+		result.User = firstSubmatch(firstRunUserRegex, string(firstRun))
+		for _, match := range firstRunWifiRegex.FindAllStringSubmatch(string(firstRun), -1) {
+			result.WifiNetworks = append(result.WifiNetworks, match[1])
+		}
+		for _, match := range wpaSSIDRegex.FindAllStringSubmatch(string(firstRun), -1) {
+			result.WifiNetworks = append(result.WifiNetworks, match[1])
+		}
+	}
+
+	if result.CloudInit {
+		if userData, err := os.ReadFile(filepath.Join(bootPath, "user-data")); err == nil {
+			result.Hostname = unquoteYAML(firstSubmatch(userDataHostnameRegex, string(userData)))
+			result.User = unquoteYAML(firstSubmatch(userDataUserRegex, string(userData)))
+		}
+		if networkConfig, err := os.ReadFile(filepath.Join(bootPath, "network-config")); err == nil {
+			for _, match := range accessPointRegex.FindAllStringSubmatch(string(networkConfig), -1) {
+				result.WifiNetworks = append(result.WifiNetworks, unquoteYAML(match[1]))
+			}
+		}
+	}
+
+	// Legacy configuration files, used by Raspberry Pi OS before the firstrun.sh script
+	if userConf, err := os.ReadFile(filepath.Join(bootPath, "userconf.txt")); err == nil && result.User == "" {
+		result.User, _, _ = strings.Cut(strings.TrimSpace(string(userConf)), ":")
+	}
+	if wpaSupplicant, err := os.ReadFile(filepath.Join(bootPath, "wpa_supplicant.conf")); err == nil {
+		for _, match := range wpaSSIDRegex.FindAllStringSubmatch(string(wpaSupplicant), -1) {
+			result.WifiNetworks = append(result.WifiNetworks, match[1])
+		}
+	}
+
+	result.WifiNetworks = removeDuplicates(result.WifiNetworks)
+	return result, nil
+}
+
+// firstSubmatch returns the first non empty group of the first match
+func firstSubmatch(r *regexp.Regexp, content string) string {
+	matches := r.FindStringSubmatch(content)
+	if len(matches) == 0 {
+		return ""
+	}
+	for _, match := range matches[1:] {
+		if match != "" {
+			return match
+		}
+	}
+	return ""
+}
+
+func unquoteYAML(value string) string {
+	value = strings.TrimSpace(value)
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		return unquoted
+	}
+	return strings.Trim(value, "'")
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func removeDuplicates[T comparable](slice []T) []T {
+	seen := make(map[T]bool)
+	result := []T{}
+
+	for _, val := range slice {
+		if _, ok := seen[val]; !ok {
+			seen[val] = true
+			result = append(result, val)
+		}
+	}
+	return result
+}
@@ -0,0 +1,71 @@
+package boot
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+)
+
+const serialConsole = "serial0,115200"
+
+// SerialConsoleWiring explains how to connect a USB to serial (3.3V) cable
+// to the GPIO header
+const SerialConsoleWiring = `Connect a 3.3V USB to serial cable to the GPIO header:
+    GND -> pin 6 (GND)
+    RX  -> pin 8 (GPIO14, TXD)
+    TX  -> pin 10 (GPIO15, RXD)
+Don't connect the VCC wire. Open the console with 115200 baud, 8N1 (e.g. screen /dev/ttyUSB0 115200).`
+
+// enableSerialConsole enables the UART in config.txt and adds the serial
+// console to cmdline.txt, before console=tty1. The kernel uses the last
+// console as /dev/console, so the boot messages are still shown in the screen.
+func (b BootManager) enableSerialConsole(bootPath string) error {
+	info.Title("Enabling serial console")
+
+	configPath := filepath.Join(bootPath, "config.txt")
+	config, err := ReadConfigTxt(configPath)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+	config.Set("all", "enable_uart", "1")
+	err = config.Write(configPath)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	cmdLinePath := filepath.Join(bootPath, "cmdline.txt")
+	cmdLine, err := ReadCmdLine(cmdLinePath)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	// Remove other serial consoles (e.g. a different baud rate)
+	for _, value := range cmdLine.Values("console") {
+		if value != serialConsole && isSerialConsole(value) {
+			cmdLine.RemoveValue("console", value)
+		}
+	}
+	cmdLine.AddBefore("console", serialConsole, "console")
+
+	err = cmdLine.Write(cmdLinePath)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	info.Ok()
+	return nil
+}
+
+func isSerialConsole(console string) bool {
+	for _, prefix := range []string{"serial", "ttyAMA", "ttyS"} {
+		if strings.HasPrefix(console, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,63 @@
+package boot
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+)
+
+// Modules that make the raspberry act as an ethernet device over USB (OTG)
+var usbGadgetModules = []string{"dwc2", "g_ether"}
+
+// DefaultUsbGadgetIP is the address of the raspberry in the usb0 interface.
+// The computer must use another address of the same subnet (e.g. 192.168.7.1/24).
+var DefaultUsbGadgetIP = &net.IPNet{IP: net.IPv4(192, 168, 7, 2).To4(), Mask: net.CIDRMask(24, 32)}
+
+// enableUsbGadget loads the dwc2 overlay in config.txt and the gadget modules
+// in cmdline.txt, just after rootwait
+func (b BootManager) enableUsbGadget(bootPath string) error {
+	info.Title("Enabling USB gadget mode")
+
+	configPath := filepath.Join(bootPath, "config.txt")
+	config, err := ReadConfigTxt(configPath)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+	config.SetOverlay("all", "dwc2")
+	err = config.Write(configPath)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	cmdLinePath := filepath.Join(bootPath, "cmdline.txt")
+	cmdLine, err := ReadCmdLine(cmdLinePath)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	modules := []string{}
+	if value, ok := cmdLine.Get("modules-load"); ok && len(value) > 0 {
+		modules = strings.Split(value, ",")
+	}
+	for _, module := range usbGadgetModules {
+		if !slices.Contains(modules, module) {
+			modules = append(modules, module)
+		}
+	}
+	cmdLine.SetAfter("modules-load", strings.Join(modules, ","), "rootwait")
+
+	err = cmdLine.Write(cmdLinePath)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	info.Ok()
+	return nil
+}
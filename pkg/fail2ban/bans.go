@@ -0,0 +1,56 @@
+package fail2ban
+
+import (
+	"fmt"
+
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+)
+
+type BansArgs struct {
+	UseSSHKey bool
+	KeyPath   string
+	User      string
+	Password  string
+	Host      string
+	Port      int
+	// IPs unbanned before getting the status
+	Unban []string
+}
+
+// Bans connects to the server, unbans the requested IPs and returns the
+// status of the sshd jail
+func Bans(args BansArgs) (JailStatus, error) {
+	address := fmt.Sprintf("%s:%d", args.Host, args.Port)
+	conn := ssh.SSHConnection{
+		Password:  args.Password,
+		UseSSHKey: args.UseSSHKey,
+		KeyPath:   args.KeyPath,
+	}
+
+	info.Title("Connecting to %s", address)
+	err := conn.Connect(args.User, address)
+	if err != nil {
+		info.Fail()
+		return JailStatus{}, err
+	}
+	defer conn.Close()
+	info.Ok()
+
+	sudoPassword := ""
+	if _, _, err := conn.Run("sudo -n true"); err != nil {
+		sudoPassword = args.Password
+	}
+	manager := NewManager(conn, sudoPassword)
+
+	for _, ip := range args.Unban {
+		info.Title("Unbanning %s", ip)
+		if err := manager.Unban(ip); err != nil {
+			info.Fail()
+			return JailStatus{}, err
+		}
+		info.Ok()
+	}
+
+	return manager.Status()
+}
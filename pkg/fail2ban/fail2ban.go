@@ -0,0 +1,241 @@
+package fail2ban
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+)
+
+// Managed jail configuration. Files of jail.d override jail.conf.
+const jailPath = "/etc/fail2ban/jail.d/rpi-provisioner.local"
+
+const sshdJail = "sshd"
+
+// Networks always ignored: localhost and tailscale (IPv4 CGNAT range and
+// IPv6 ULA prefix)
+var defaultIgnoreIPs = []string{"127.0.0.1/8", "::1", "100.64.0.0/10", "fd7a:115c:a1e0::/48"}
+
+// Jail is the configuration of the sshd jail
+type Jail struct {
+	// SSH port watched by the jail
+	Port int
+	// Extra IPs or networks that are never banned. The local subnets of the
+	// server are added automatically.
+	IgnoreIPs []string
+	MaxRetry  int
+	FindTime  string
+	BanTime   string
+}
+
+func DefaultJail(port int) Jail {
+	return Jail{
+		Port:     port,
+		MaxRetry: 5,
+		FindTime: "10m",
+		BanTime:  "1h",
+	}
+}
+
+// Render returns the content of the managed jail file
+func (j Jail) Render(localSubnets []string) string {
+	ignoreIPs := append(append(append([]string{}, defaultIgnoreIPs...), localSubnets...), j.IgnoreIPs...)
+	lines := []string{
+		"# Managed by rpi-provisioner, changes will be overwritten",
+		"[" + sshdJail + "]",
+		"enabled = true",
+		fmt.Sprintf("port = %d", j.Port),
+		// Raspberry Pi OS doesn't write /var/log/auth.log since bookworm
+		"backend = systemd",
+		fmt.Sprintf("maxretry = %d", j.MaxRetry),
+		"findtime = " + j.FindTime,
+		"bantime = " + j.BanTime,
+		"ignoreip = " + strings.Join(unique(ignoreIPs), " "),
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// JailStatus is the output of fail2ban-client status
+type JailStatus struct {
+	Jail            string
+	CurrentlyFailed int
+	TotalFailed     int
+	CurrentlyBanned int
+	TotalBanned     int
+	BannedIPs       []string
+}
+
+func NewManager(conn ssh.SSHConnection, sudoPassword string) *fail2banManager {
+	return &fail2banManager{conn: conn, sudoPassword: sudoPassword}
+}
+
+type fail2banManager struct {
+	conn         ssh.SSHConnection
+	sudoPassword string
+}
+
+// Install installs fail2ban and the python bindings of the systemd journal.
+// The bindings are also installed if fail2ban already is, as the jail uses
+// the systemd backend.
+func (m *fail2banManager) Install() (bool, error) {
+	_, _, err := m.conn.Run("command -v fail2ban-client && python3 -c \"import systemd.journal\"")
+	if err == nil {
+		return false, nil
+	}
+	installCmd := "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y fail2ban python3-systemd"
+	if err := m.sudo(installCmd); err != nil {
+		return false, fmt.Errorf("error installing fail2ban: %w", err)
+	}
+	return true, nil
+}
+
+// Configure writes the sshd jail and restarts fail2ban if it changed. The
+// configuration is tested before restarting, and removed if it is invalid.
+func (m *fail2banManager) Configure(jail Jail) (bool, error) {
+	subnets, err := m.localSubnets()
+	if err != nil {
+		return false, err
+	}
+	content := jail.Render(subnets)
+
+	previous, _, err := m.conn.RunSudoPassword("cat "+jailPath, m.sudoPassword)
+	if err == nil && previous == content {
+		return false, nil
+	}
+
+	tmpPath := "/tmp/rpi-provisioner-jail.local"
+	err = m.conn.WriteToFile(tmpPath, []byte(content))
+	if err != nil {
+		return false, fmt.Errorf("error uploading jail config: %w", err)
+	}
+	installCmd := fmt.Sprintf("install -m 644 -o root -g root %s %s && rm %s", tmpPath, jailPath, tmpPath)
+	if err := m.sudo(installCmd); err != nil {
+		return false, fmt.Errorf("error updating %s: %w", jailPath, err)
+	}
+
+	if err := m.sudo("fail2ban-client -t"); err != nil {
+		if previous == "" {
+			m.sudo("rm -f " + jailPath)
+		} else {
+			m.conn.WriteToFile(tmpPath, []byte(previous))
+			m.sudo(installCmd)
+		}
+		return false, fmt.Errorf("invalid fail2ban config: %w", err)
+	}
+
+	if err := m.sudo("systemctl enable fail2ban && systemctl restart fail2ban"); err != nil {
+		return false, fmt.Errorf("error restarting fail2ban: %w", err)
+	}
+	return true, nil
+}
+
+// SetPort updates the port of the managed jail, if fail2ban was configured
+func (m *fail2banManager) SetPort(port int) (bool, error) {
+	if _, _, err := m.conn.RunSudoPassword("test -f "+jailPath, m.sudoPassword); err != nil {
+		return false, nil
+	}
+	updateCmd := fmt.Sprintf("sed -i \"s/^port = .*/port = %d/\" %s && systemctl reload fail2ban", port, jailPath)
+	if err := m.sudo(updateCmd); err != nil {
+		return false, fmt.Errorf("error updating fail2ban port: %w", err)
+	}
+	return true, nil
+}
+
+// Status returns the failures and bans of the sshd jail
+func (m *fail2banManager) Status() (JailStatus, error) {
+	stdout, stderr, err := m.conn.RunSudoPassword("fail2ban-client status "+sshdJail, m.sudoPassword)
+	if err != nil {
+		return JailStatus{}, fmt.Errorf("error getting fail2ban status: %w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return parseStatus(sshdJail, stdout), nil
+}
+
+// Unban removes the ban of ip in the sshd jail
+func (m *fail2banManager) Unban(ip string) error {
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("invalid IP address '%s'", ip)
+	}
+	if err := m.sudo(fmt.Sprintf("fail2ban-client set %s unbanip %s", sshdJail, ip)); err != nil {
+		return fmt.Errorf("error unbanning %s: %w", ip, err)
+	}
+	return nil
+}
+
+// localSubnets returns the IPv4 networks of the interfaces of the server,
+// except the tailscale one (it is already ignored)
+func (m *fail2banManager) localSubnets() ([]string, error) {
+	stdout, _, err := m.conn.Run("ip -o -f inet addr show scope global")
+	if err != nil {
+		return nil, fmt.Errorf("error getting local subnets: %w", err)
+	}
+
+	subnets := []string{}
+	for _, line := range strings.Split(stdout, "\n") {
+		// Format: 2: eth0    inet 192.168.0.71/24 brd 192.168.0.255 scope global eth0
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] == "tailscale0" || fields[2] != "inet" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(fields[3])
+		if err != nil {
+			continue
+		}
+		subnets = append(subnets, network.String())
+	}
+	return subnets, nil
+}
+
+// parseStatus parses the output of fail2ban-client status <jail>:
+//
+//	|- Filter
+//	|  |- Currently failed:	0
+//	...
+//	`- Actions
+//	   |- Currently banned:	1
+//	   `- Banned IP list:	192.0.2.1
+func parseStatus(jail, output string) JailStatus {
+	status := JailStatus{Jail: jail, BannedIPs: []string{}}
+	for _, line := range strings.Split(output, "\n") {
+		key, value, found := strings.Cut(strings.TrimLeft(line, "|`- "), ":")
+		if !found {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		number, _ := strconv.Atoi(value)
+		switch strings.TrimSpace(key) {
+		case "Currently failed":
+			status.CurrentlyFailed = number
+		case "Total failed":
+			status.TotalFailed = number
+		case "Currently banned":
+			status.CurrentlyBanned = number
+		case "Total banned":
+			status.TotalBanned = number
+		case "Banned IP list":
+			status.BannedIPs = strings.Fields(value)
+		}
+	}
+	return status
+}
+
+func (m *fail2banManager) sudo(cmd string) error {
+	_, stderr, err := m.conn.RunSudoPassword(cmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("%w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+func unique(values []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
+}
@@ -11,10 +11,13 @@ import (
 
 type Args struct {
 	Subnet    string
+	Interface string
 	User      string
 	Password  string
 	UseSSHKey bool
 	Port      int
+	// Manifest written by the boot command to reconcile with the hosts found
+	Manifest string
 }
 
 type Finder struct {
@@ -22,6 +25,7 @@ type Finder struct {
 	wg       sync.WaitGroup
 	totalIPs []net.IP
 	validIPs []net.IP
+	hosts    []hostInfo
 	findArgs Args
 }
 
@@ -31,6 +35,13 @@ func NewFinder() *Finder {
 
 func (f *Finder) Run(args Args) error {
 	CIDR := args.Subnet
+	if CIDR == "" && args.Interface != "" {
+		interfaceCIDR, err := getInterfaceCIDR(args.Interface)
+		if err != nil {
+			return err
+		}
+		CIDR = interfaceCIDR
+	}
 	if CIDR == "" {
 		defaultCDIR, err := getDefaultCDIR()
 		if err != nil {
@@ -54,6 +65,10 @@ func (f *Finder) Run(args Args) error {
 
 	elapsed := time.Since(start)
 	fmt.Printf("Done (%s): %d valid hosts out of %d\n", elapsed, len(validIPs), len(ipv4List))
+
+	if args.Manifest != "" {
+		return f.reconcile(args.Manifest)
+	}
 	return nil
 }
 
@@ -75,10 +90,19 @@ func (f *Finder) checkSSHConnection(ipv4Addr net.IP) {
 	}
 	addr := fmt.Sprintf("%v:%d", ipv4Addr, f.findArgs.Port)
 	err := connection.Connect(f.findArgs.User, addr)
-	if err == nil {
-		f.mu.Lock()
-		f.validIPs = append(f.validIPs, ipv4Addr)
-		fmt.Printf("Found valid host: %v\n", ipv4Addr)
-		f.mu.Unlock()
+	if err != nil {
+		return
 	}
+	defer connection.Close()
+
+	host := hostInfo{IP: ipv4Addr}
+	if f.findArgs.Manifest != "" {
+		host = getHostInfo(connection, ipv4Addr)
+	}
+
+	f.mu.Lock()
+	f.validIPs = append(f.validIPs, ipv4Addr)
+	f.hosts = append(f.hosts, host)
+	fmt.Printf("Found valid host: %v\n", ipv4Addr)
+	f.mu.Unlock()
 }
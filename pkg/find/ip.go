@@ -43,6 +43,31 @@ func getDefaultCDIR() (string, error) {
 	return fmt.Sprintf("%v/24", localIP), nil
 }
 
+// getInterfaceCIDR returns the subnet of the first IPv4 address of the
+// interface (e.g. usb0 when the raspberry is connected in USB gadget mode)
+func getInterfaceCIDR(name string) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("error getting interface %s: %w", name, err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("error getting interface addresses: %w", err)
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		network := net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask}
+		return network.String(), nil
+	}
+
+	return "", fmt.Errorf("interface %s has no IPv4 address", name)
+}
+
 func isInterfaceBlacklisted(iName string) bool {
 	for _, blacklistedName := range BlacklistedInterfaces {
 		if blacklistedName == iName {
@@ -0,0 +1,102 @@
+package find
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+	"github.com/sralloza/rpi-provisioner/pkg/state"
+)
+
+type hostInfo struct {
+	IP       net.IP
+	Hostname string
+	MACs     []string
+}
+
+func getHostInfo(conn ssh.SSHConnection, ip net.IP) hostInfo {
+	host := hostInfo{IP: ip}
+
+	stdout, _, err := conn.Run("hostname")
+	if err == nil {
+		host.Hostname = strings.TrimSpace(stdout)
+	}
+
+	stdout, _, err = conn.Run("cat /sys/class/net/*/address")
+	if err == nil {
+		for _, mac := range strings.Fields(stdout) {
+			if mac != "00:00:00:00:00:00" {
+				host.MACs = append(host.MACs, strings.ToLower(mac))
+			}
+		}
+	}
+	return host
+}
+
+func (h hostInfo) hasMAC(mac string) bool {
+	for _, hostMAC := range h.MACs {
+		if hostMAC == strings.ToLower(mac) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcile compares the hosts found with the raspberries of the manifest.
+// Hosts are matched by MAC address if the manifest has it, otherwise by hostname.
+func (f *Finder) reconcile(manifestPath string) error {
+	entries, err := state.LoadManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+
+	matched := map[string]bool{}
+	fmt.Printf("\nManifest %s:\n", manifestPath)
+	for _, entry := range entries {
+		host, found := f.matchHost(entry)
+		switch {
+		case !found:
+			fmt.Printf("  %-20s not found\n", entry.Hostname)
+		case host.Hostname != entry.Hostname:
+			fmt.Printf("  %-20s found in %v with hostname %s\n", entry.Hostname, host.IP, host.Hostname)
+		case entry.MAC != "" && !host.hasMAC(entry.MAC):
+			fmt.Printf("  %-20s found in %v, MAC mismatch (expected %s, got %s)\n",
+				entry.Hostname, host.IP, entry.MAC, strings.Join(host.MACs, ", "))
+		default:
+			fmt.Printf("  %-20s found in %v\n", entry.Hostname, host.IP)
+		}
+		if found {
+			matched[host.IP.String()] = true
+		}
+	}
+
+	unknown := []string{}
+	for _, host := range f.hosts {
+		if !matched[host.IP.String()] {
+			unknown = append(unknown, fmt.Sprintf("  %-20s %v", host.Hostname, host.IP))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		fmt.Printf("\nHosts not in the manifest:\n%s\n", strings.Join(unknown, "\n"))
+	}
+	return nil
+}
+
+func (f *Finder) matchHost(entry state.ManifestEntry) (hostInfo, bool) {
+	if entry.MAC != "" {
+		for _, host := range f.hosts {
+			if host.hasMAC(entry.MAC) {
+				return host, true
+			}
+		}
+	}
+	for _, host := range f.hosts {
+		if host.Hostname == entry.Hostname {
+			return host, true
+		}
+	}
+	return hostInfo{}, false
+}
@@ -0,0 +1,262 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+)
+
+// Directory of the server where the previous firewall is saved before
+// applying new rules
+const backupDir = "/var/backups/rpi-provisioner/firewall"
+
+// Script that restores the previous firewall, executed by the revert timer
+const revertScript = backupDir + "/revert.sh"
+
+// Transient systemd unit that runs the revert script after the timeout
+const revertUnit = "rpi-provisioner-firewall-revert"
+
+type FirewallArgs struct {
+	UseSSHKey bool
+	KeyPath   string
+	User      string
+	Password  string
+	Host      string
+	Port      int
+	Rules     Rules
+}
+
+// backend manages the rules with a specific tool
+type backend interface {
+	// Package installed with apt if the tool is missing
+	packageName() string
+	command() string
+	// Commands that save the current firewall in backupDir
+	backupCommands() []string
+	// Shell script that restores the firewall saved in backupDir
+	revertScript() string
+	apply(m *firewallManager, rules Rules) error
+	// Allows or removes a single port of the applied rules
+	allowPort(m *firewallManager, port Port) (bool, error)
+	removePort(m *firewallManager, port Port) (bool, error)
+	// Makes the rules survive a reboot
+	persist(m *firewallManager) error
+}
+
+func getBackend(name string) backend {
+	if name == BackendNftables {
+		return nftablesBackend{}
+	}
+	return ufwBackend{}
+}
+
+func NewManager(conn ssh.SSHConnection, sudoPassword string) *firewallManager {
+	return &firewallManager{conn: conn, sudoPassword: sudoPassword}
+}
+
+type firewallManager struct {
+	conn         ssh.SSHConnection
+	sudoPassword string
+}
+
+// Configure connects to the server and applies the rules, verifying that
+// new ssh connections are still accepted
+func Configure(args FirewallArgs) error {
+	if err := args.Rules.Validate(); err != nil {
+		return err
+	}
+
+	address := fmt.Sprintf("%s:%d", args.Host, args.Port)
+	conn := ssh.SSHConnection{
+		Password:  args.Password,
+		UseSSHKey: args.UseSSHKey,
+		KeyPath:   args.KeyPath,
+	}
+
+	info.Title("Connecting to %s", address)
+	err := conn.Connect(args.User, address)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+	defer conn.Close()
+	info.Ok()
+
+	sudoPassword := ""
+	if _, _, err := conn.Run("sudo -n true"); err != nil {
+		sudoPassword = args.Password
+	}
+
+	sshAddress := fmt.Sprintf("%s:%d", args.Host, args.Rules.SSHPort)
+	return NewManager(conn, sudoPassword).Apply(args.Rules, func() error {
+		return conn.CheckLogin(args.User, sshAddress)
+	})
+}
+
+// Apply replaces the firewall with the rules. Before applying them, a timer
+// that restores the previous firewall is scheduled. The timer is cancelled
+// only if verify succeeds, so a rule set that blocks ssh is reverted even if
+// the connection is lost.
+func (m *firewallManager) Apply(rules Rules, verify func() error) error {
+	if err := rules.Validate(); err != nil {
+		return err
+	}
+	b := getBackend(rules.Backend)
+
+	info.Title("Installing %s", b.packageName())
+	if installed, err := m.install(b); err != nil {
+		info.Fail()
+		return err
+	} else if installed {
+		info.Ok()
+	} else {
+		info.Skipped()
+	}
+
+	info.Title("Scheduling firewall auto-revert in %ds", rules.RevertTimeout)
+	if err := m.scheduleRevert(b, rules.RevertTimeout); err != nil {
+		info.Fail()
+		return err
+	}
+	info.Ok()
+
+	info.Title("Applying firewall rules")
+	if err := b.apply(m, rules); err != nil {
+		info.Fail()
+		m.Revert()
+		return err
+	}
+	info.Ok()
+
+	info.Title("Verifying new ssh connection")
+	if err := verify(); err != nil {
+		info.Fail()
+		if revertErr := m.Revert(); revertErr != nil {
+			return fmt.Errorf("new ssh connections are rejected, the previous firewall will be restored in %ds: %w", rules.RevertTimeout, err)
+		}
+		return fmt.Errorf("new ssh connections are rejected, the previous firewall was restored: %w", err)
+	}
+	info.Ok()
+
+	info.Title("Saving firewall rules")
+	if err := m.cancelRevert(); err != nil {
+		info.Fail()
+		return err
+	}
+	if err := b.persist(m); err != nil {
+		info.Fail()
+		return err
+	}
+	info.Ok()
+	return nil
+}
+
+// Revert restores the firewall saved before the last Apply. It does
+// nothing if the rules were never applied.
+func (m *firewallManager) Revert() error {
+	revertCmd := fmt.Sprintf("if [ -f %s ]; then sh %s; fi", revertScript, revertScript)
+	if err := m.sudo(revertCmd); err != nil {
+		return fmt.Errorf("error reverting firewall: %w", err)
+	}
+	return m.cancelRevert()
+}
+
+// Managed returns the backend of the firewall enabled in the server, or an
+// empty string if there is no firewall
+func (m *firewallManager) Managed() string {
+	if _, _, err := m.conn.RunSudoPassword("test -f "+nftablesDropIn, m.sudoPassword); err == nil {
+		return BackendNftables
+	}
+	stdout, _, err := m.conn.RunSudoPassword("ufw status", m.sudoPassword)
+	if err == nil && strings.Contains(stdout, "Status: active") {
+		return BackendUFW
+	}
+	return ""
+}
+
+// AllowPort adds port to the firewall of the server. It returns false if
+// there is no firewall or the port is already allowed.
+func (m *firewallManager) AllowPort(port Port) (bool, error) {
+	backend := m.Managed()
+	if backend == "" {
+		return false, nil
+	}
+	return getBackend(backend).allowPort(m, port)
+}
+
+// RemovePort removes a port previously allowed in the firewall of the server
+func (m *firewallManager) RemovePort(port Port) (bool, error) {
+	backend := m.Managed()
+	if backend == "" {
+		return false, nil
+	}
+	return getBackend(backend).removePort(m, port)
+}
+
+func (m *firewallManager) install(b backend) (bool, error) {
+	_, _, err := m.conn.Run("command -v " + b.command())
+	if err == nil {
+		return false, nil
+	}
+	installCmd := "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y " + b.packageName()
+	if err := m.sudo(installCmd); err != nil {
+		return false, fmt.Errorf("error installing %s: %w", b.packageName(), err)
+	}
+	return true, nil
+}
+
+// scheduleRevert saves the current firewall and starts a transient timer
+// that restores it after timeout seconds
+func (m *firewallManager) scheduleRevert(b backend, timeout int) error {
+	commands := append([]string{
+		fmt.Sprintf("mkdir -p %s", backupDir),
+		fmt.Sprintf("chmod 700 %s", backupDir),
+	}, b.backupCommands()...)
+	if err := m.sudo(strings.Join(commands, " && ")); err != nil {
+		return fmt.Errorf("error saving current firewall: %w", err)
+	}
+
+	script := "#!/bin/sh\n# Restores the firewall saved by rpi-provisioner\n" + b.revertScript()
+	if err := m.upload(revertScript, script, "700"); err != nil {
+		return err
+	}
+
+	m.cancelRevert()
+	scheduleCmd := fmt.Sprintf("systemd-run --unit=%s --on-active=%ds /bin/sh %s", revertUnit, timeout, revertScript)
+	if err := m.sudo(scheduleCmd); err != nil {
+		return fmt.Errorf("error scheduling firewall revert: %w", err)
+	}
+	return nil
+}
+
+func (m *firewallManager) cancelRevert() error {
+	cancelCmd := fmt.Sprintf("systemctl stop %s.timer 2>/dev/null; systemctl reset-failed %s.service 2>/dev/null; true", revertUnit, revertUnit)
+	if err := m.sudo(cancelCmd); err != nil {
+		return fmt.Errorf("error cancelling firewall revert: %w", err)
+	}
+	return nil
+}
+
+func (m *firewallManager) upload(path, content, mode string) error {
+	tmpPath := "/tmp/rpi-provisioner-firewall"
+	err := m.conn.WriteToFile(tmpPath, []byte(content))
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %w", path, err)
+	}
+
+	installCmd := fmt.Sprintf("install -D -m %s -o root -g root %s %s && rm %s", mode, tmpPath, path, tmpPath)
+	if err := m.sudo(installCmd); err != nil {
+		return fmt.Errorf("error updating %s: %w", path, err)
+	}
+	return nil
+}
+
+func (m *firewallManager) sudo(cmd string) error {
+	_, stderr, err := m.conn.RunSudoPassword(cmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("%w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	nftablesConfig = "/etc/nftables.conf"
+	// Managed file with the table of rpi-provisioner, included by
+	// nftablesConfig. Only this table is replaced, so the rules of other
+	// programs (like docker or tailscale) are kept.
+	nftablesDropIn  = "/etc/nftables.d/rpi-provisioner.nft"
+	nftablesInclude = `include "/etc/nftables.d/*.nft"`
+	nftablesTable   = "inet rpi_provisioner"
+)
+
+type nftablesBackend struct{}
+
+func (nftablesBackend) packageName() string { return "nftables" }
+
+func (nftablesBackend) command() string { return "nft" }
+
+func (nftablesBackend) backupCommands() []string {
+	return []string{
+		fmt.Sprintf("rm -f %s/nftables.conf %s/rpi-provisioner.nft", backupDir, backupDir),
+		fmt.Sprintf("if [ -f %s ]; then cp -p %s %s/; fi", nftablesConfig, nftablesConfig, backupDir),
+		fmt.Sprintf("if [ -f %s ]; then cp -p %s %s/; fi", nftablesDropIn, nftablesDropIn, backupDir),
+	}
+}
+
+func (nftablesBackend) revertScript() string {
+	return fmt.Sprintf(`nft delete table %s 2>/dev/null
+rm -f %s
+if [ -f %s/nftables.conf ]; then
+  cp -p %s/nftables.conf %s
+fi
+if [ -f %s/rpi-provisioner.nft ]; then
+  cp -p %s/rpi-provisioner.nft %s
+  nft -f %s
+fi
+`, nftablesTable, nftablesDropIn, backupDir, backupDir, nftablesConfig,
+		backupDir, backupDir, nftablesDropIn, nftablesDropIn)
+}
+
+// render returns the managed table. Creating and deleting the table first
+// makes the file idempotent.
+func (nftablesBackend) render(rules Rules) string {
+	lines := []string{
+		"# Managed by rpi-provisioner, changes will be overwritten",
+		fmt.Sprintf("table %s {}", nftablesTable),
+		fmt.Sprintf("delete table %s", nftablesTable),
+		"",
+		fmt.Sprintf("table %s {", nftablesTable),
+		"\tchain input {",
+		"\t\ttype filter hook input priority 0; policy drop;",
+		"\t\tct state established,related accept",
+		"\t\tct state invalid drop",
+		"\t\tiifname \"lo\" accept",
+		"\t\tmeta l4proto { icmp, ipv6-icmp } accept",
+		"\t\tudp sport 67 udp dport 68 accept",
+		"\t\tip daddr 224.0.0.251 udp dport 5353 accept",
+		"\t\tip6 daddr ff02::fb udp dport 5353 accept",
+	}
+	if rules.AllowTailscale {
+		lines = append(lines, "\t\tiifname \"tailscale0\" accept")
+	}
+	for _, port := range rules.allowedPorts() {
+		lines = append(lines, nftablesPortRule(port))
+	}
+	lines = append(lines, "\t}", "}")
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func (b nftablesBackend) apply(m *firewallManager, rules Rules) error {
+	return b.load(m, b.render(rules))
+}
+
+func (b nftablesBackend) allowPort(m *firewallManager, port Port) (bool, error) {
+	lines, err := b.current(m)
+	if err != nil {
+		return false, err
+	}
+	rule := nftablesPortRule(port)
+	for _, line := range lines {
+		if line == rule {
+			return false, nil
+		}
+	}
+
+	// The last two lines close the chain and the table
+	if len(lines) < 2 {
+		return false, fmt.Errorf("invalid %s", nftablesDropIn)
+	}
+	i := len(lines) - 2
+	lines = append(lines[:i], append([]string{rule}, lines[i:]...)...)
+	return true, b.load(m, strings.Join(lines, "\n")+"\n")
+}
+
+func (b nftablesBackend) removePort(m *firewallManager, port Port) (bool, error) {
+	lines, err := b.current(m)
+	if err != nil {
+		return false, err
+	}
+	rule := nftablesPortRule(port)
+	result := []string{}
+	for _, line := range lines {
+		if line != rule {
+			result = append(result, line)
+		}
+	}
+	if len(result) == len(lines) {
+		return false, nil
+	}
+	return true, b.load(m, strings.Join(result, "\n")+"\n")
+}
+
+// current returns the lines of the managed table
+func (nftablesBackend) current(m *firewallManager) ([]string, error) {
+	content, _, err := m.conn.RunSudoPassword("cat "+nftablesDropIn, m.sudoPassword)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", nftablesDropIn, err)
+	}
+	return strings.Split(strings.TrimRight(content, "\n"), "\n"), nil
+}
+
+// load checks the rules with nft -c before installing and loading them
+func (nftablesBackend) load(m *firewallManager, content string) error {
+	tmpPath := "/tmp/rpi-provisioner.nft"
+	err := m.conn.WriteToFile(tmpPath, []byte(content))
+	if err != nil {
+		return fmt.Errorf("error uploading nftables rules: %w", err)
+	}
+	if err := m.sudo(fmt.Sprintf("nft -c -f %s", tmpPath)); err != nil {
+		m.sudo("rm -f " + tmpPath)
+		return fmt.Errorf("invalid nftables rules: %w", err)
+	}
+
+	installCmd := fmt.Sprintf("install -D -m 644 -o root -g root %s %s && rm %s && nft -f %s",
+		tmpPath, nftablesDropIn, tmpPath, nftablesDropIn)
+	if err := m.sudo(installCmd); err != nil {
+		return fmt.Errorf("error applying nftables rules: %w", err)
+	}
+	return nil
+}
+
+func nftablesPortRule(port Port) string {
+	return fmt.Sprintf("\t\t%s dport %d accept", port.Protocol, port.Number)
+}
+
+// persist includes the drop-in in the config loaded by the nftables service
+// and enables it
+func (nftablesBackend) persist(m *firewallManager) error {
+	config, _, err := m.conn.RunSudoPassword("cat "+nftablesConfig, m.sudoPassword)
+	if err != nil {
+		config = "#!/usr/sbin/nft -f\n"
+	}
+	if !strings.Contains(config, nftablesInclude) {
+		config = strings.TrimRight(config, "\n") + "\n\n" + nftablesInclude + "\n"
+		if err := m.upload(nftablesConfig, config, "755"); err != nil {
+			return err
+		}
+	}
+
+	if err := m.sudo("systemctl enable nftables"); err != nil {
+		return fmt.Errorf("error enabling nftables service: %w", err)
+	}
+	return nil
+}
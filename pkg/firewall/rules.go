@@ -0,0 +1,103 @@
+package firewall
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	BackendUFW      = "ufw"
+	BackendNftables = "nftables"
+)
+
+// Port used by tailscale for direct (peer to peer) connections
+const tailscalePort = 41641
+
+// Rules is the firewall applied to the server: everything inbound is denied
+// except the ssh port, the tailscale interface and the declared ports
+type Rules struct {
+	Backend        string
+	SSHPort        int
+	AllowTailscale bool
+	Ports          []Port
+	// Seconds before the previous firewall is restored if the new rules are
+	// not confirmed (e.g. because they block ssh)
+	RevertTimeout int
+}
+
+type Port struct {
+	Number   int
+	Protocol string
+}
+
+func (p Port) String() string {
+	return fmt.Sprintf("%d/%s", p.Number, p.Protocol)
+}
+
+// ParsePort parses ports like 80, 80/tcp or 53/udp (tcp by default)
+func ParsePort(value string) (Port, error) {
+	number, protocol, hasProtocol := strings.Cut(value, "/")
+	if !hasProtocol {
+		protocol = "tcp"
+	}
+	protocol = strings.ToLower(protocol)
+	if protocol != "tcp" && protocol != "udp" {
+		return Port{}, fmt.Errorf("invalid port '%s': protocol must be tcp or udp", value)
+	}
+
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > 65535 {
+		return Port{}, fmt.Errorf("invalid port '%s': must be a number between 1 and 65535", value)
+	}
+	return Port{Number: n, Protocol: protocol}, nil
+}
+
+func ParsePorts(values []string) ([]Port, error) {
+	ports := []Port{}
+	for _, value := range values {
+		port, err := ParsePort(value)
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+func Backends() []string {
+	return []string{BackendUFW, BackendNftables}
+}
+
+func (r Rules) Validate() error {
+	if r.Backend != BackendUFW && r.Backend != BackendNftables {
+		return fmt.Errorf("unknown firewall backend '%s' (valid backends: %s)", r.Backend, strings.Join(Backends(), ", "))
+	}
+	if r.SSHPort < 1 || r.SSHPort > 65535 {
+		return fmt.Errorf("invalid ssh port %d", r.SSHPort)
+	}
+	if r.RevertTimeout < 1 {
+		return fmt.Errorf("the revert timeout must be positive")
+	}
+	return nil
+}
+
+// allowedPorts returns the ssh port, the tailscale port (if enabled) and the
+// declared ports, without duplicates
+func (r Rules) allowedPorts() []Port {
+	ports := []Port{{Number: r.SSHPort, Protocol: "tcp"}}
+	if r.AllowTailscale {
+		ports = append(ports, Port{Number: tailscalePort, Protocol: "udp"})
+	}
+	ports = append(ports, r.Ports...)
+
+	seen := map[Port]bool{}
+	result := []Port{}
+	for _, port := range ports {
+		if !seen[port] {
+			seen[port] = true
+			result = append(result, port)
+		}
+	}
+	return result
+}
@@ -0,0 +1,97 @@
+package firewall
+
+import (
+	"fmt"
+	"strings"
+)
+
+type ufwBackend struct{}
+
+func (ufwBackend) packageName() string { return "ufw" }
+
+func (ufwBackend) command() string { return "ufw" }
+
+func (ufwBackend) backupCommands() []string {
+	return []string{
+		fmt.Sprintf("rm -rf %s/ufw", backupDir),
+		fmt.Sprintf("cp -a /etc/ufw %s/ufw", backupDir),
+		fmt.Sprintf("ufw status > %s/ufw-status", backupDir),
+	}
+}
+
+func (ufwBackend) revertScript() string {
+	return fmt.Sprintf(`ufw --force disable
+rm -rf /etc/ufw
+cp -a %s/ufw /etc/ufw
+if grep -q "Status: active" %s/ufw-status; then
+  ufw --force enable
+fi
+`, backupDir, backupDir)
+}
+
+// commands returns the ufw commands that create the rules from scratch
+func (ufwBackend) commands(rules Rules) []string {
+	commands := []string{
+		"ufw --force reset",
+		"ufw default deny incoming",
+		"ufw default allow outgoing",
+	}
+	if rules.AllowTailscale {
+		commands = append(commands, "ufw allow in on tailscale0")
+	}
+	for _, port := range rules.allowedPorts() {
+		commands = append(commands, "ufw allow "+port.String())
+	}
+	return append(commands, "ufw --force enable")
+}
+
+func (b ufwBackend) apply(m *firewallManager, rules Rules) error {
+	if err := m.sudo(strings.Join(b.commands(rules), " && ")); err != nil {
+		return fmt.Errorf("error applying ufw rules: %w", err)
+	}
+	return nil
+}
+
+func (ufwBackend) allowPort(m *firewallManager, port Port) (bool, error) {
+	stdout, _, err := m.conn.RunSudoPassword("ufw status", m.sudoPassword)
+	if err != nil {
+		return false, fmt.Errorf("error getting ufw status: %w", err)
+	}
+	if ufwAllows(stdout, port) {
+		return false, nil
+	}
+	if err := m.sudo("ufw allow " + port.String()); err != nil {
+		return false, fmt.Errorf("error allowing port %s: %w", port, err)
+	}
+	return true, nil
+}
+
+func (ufwBackend) removePort(m *firewallManager, port Port) (bool, error) {
+	stdout, _, err := m.conn.RunSudoPassword("ufw status", m.sudoPassword)
+	if err != nil {
+		return false, fmt.Errorf("error getting ufw status: %w", err)
+	}
+	if !ufwAllows(stdout, port) {
+		return false, nil
+	}
+	if err := m.sudo("ufw delete allow " + port.String()); err != nil {
+		return false, fmt.Errorf("error removing port %s: %w", port, err)
+	}
+	return true, nil
+}
+
+// ufwAllows returns true if the output of ufw status has a rule allowing port
+func ufwAllows(status string, port Port) bool {
+	for _, line := range strings.Split(status, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == port.String() && fields[1] == "ALLOW" {
+			return true
+		}
+	}
+	return false
+}
+
+// ufw saves the rules and enables its service when it is enabled
+func (ufwBackend) persist(m *firewallManager) error {
+	return nil
+}
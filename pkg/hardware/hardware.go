@@ -0,0 +1,129 @@
+package hardware
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/rs/zerolog"
+	"github.com/sralloza/rpi-provisioner/pkg/boot"
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+	"github.com/sralloza/rpi-provisioner/pkg/logging"
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+)
+
+type HardwareArgs struct {
+	UseSSHKey bool
+	User      string
+	Password  string
+	Host      string
+	Port      int
+	Config    boot.HardwareArgs
+}
+
+// Location of config.txt, newer images mount the boot partition in /boot/firmware
+var configPaths = []string{"/boot/firmware/config.txt", "/boot/config.txt"}
+
+func NewManager() *hardwareManager {
+	return &hardwareManager{
+		log: logging.Get(),
+	}
+}
+
+type hardwareManager struct {
+	conn ssh.SSHConnection
+	log  *zerolog.Logger
+}
+
+type HardwareResult struct {
+	NeedReboot bool
+}
+
+func (m *hardwareManager) Setup(args HardwareArgs) (HardwareResult, error) {
+	result := HardwareResult{NeedReboot: false}
+
+	if !args.UseSSHKey && len(args.Password) == 0 {
+		return result, errors.New("must pass --ssh-key or --password")
+	}
+	if err := args.Config.Validate(); err != nil {
+		return result, err
+	}
+
+	address := fmt.Sprintf("%s:%d", args.Host, args.Port)
+	info.Title("Connecting to %s", address)
+	m.conn = ssh.SSHConnection{
+		Password:  args.Password,
+		UseSSHKey: args.UseSSHKey,
+	}
+	err := m.conn.Connect(args.User, address)
+	if err != nil {
+		info.Fail()
+		return result, err
+	}
+	defer m.conn.Close()
+	info.Ok()
+
+	info.Title("Updating config.txt")
+	provisioned, err := m.updateConfigTxt(args)
+	if err != nil {
+		info.Fail()
+		return result, err
+	} else if provisioned {
+		info.Ok()
+	} else {
+		info.Skipped()
+	}
+
+	result.NeedReboot = provisioned
+	return result, nil
+}
+
+func (m *hardwareManager) updateConfigTxt(args HardwareArgs) (bool, error) {
+	configPath, err := m.getConfigPath()
+	if err != nil {
+		return false, err
+	}
+
+	content, _, err := m.conn.Run(fmt.Sprintf("cat %s", configPath))
+	if err != nil {
+		return false, fmt.Errorf("error reading %s: %w", configPath, err)
+	}
+
+	config := boot.ParseConfigTxt(content)
+	changed, err := args.Config.Apply(config)
+	if err != nil {
+		return false, err
+	}
+	if !changed {
+		return false, nil
+	}
+
+	m.log.Debug().Str("path", configPath).Str("config", config.String()).Msg("Updating config.txt")
+
+	err = m.conn.WriteToFile("/tmp/config.txt", []byte(config.String()))
+	if err != nil {
+		return false, fmt.Errorf("error uploading config.txt: %w", err)
+	}
+
+	backupCmd := fmt.Sprintf("cp %s %s.backup", configPath, configPath)
+	_, _, err = m.conn.RunSudoPassword(backupCmd, args.Password)
+	if err != nil {
+		return false, fmt.Errorf("error creating backup of config.txt: %w", err)
+	}
+
+	mvCmd := fmt.Sprintf("mv /tmp/config.txt %s", configPath)
+	_, _, err = m.conn.RunSudoPassword(mvCmd, args.Password)
+	if err != nil {
+		return false, fmt.Errorf("error updating config.txt: %w", err)
+	}
+
+	return true, nil
+}
+
+func (m *hardwareManager) getConfigPath() (string, error) {
+	for _, path := range configPaths {
+		if _, _, err := m.conn.Run(fmt.Sprintf("test -f %s", path)); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("config.txt not found (%v)", configPaths)
+}
@@ -0,0 +1,310 @@
+package image
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/carlmjohnson/requests"
+	"github.com/rs/zerolog"
+	"github.com/sralloza/rpi-provisioner/pkg/boot"
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+	"github.com/sralloza/rpi-provisioner/pkg/logging"
+	"github.com/ulikunitz/xz"
+)
+
+type ImageArgs struct {
+	// URL or local path of the image (.img, .img.xz or .img.gz)
+	Source string
+	// Expected SHA-256 of the source file. If empty and the source is a URL,
+	// it is downloaded from <URL>.sha256
+	SHA256 string
+	// Don't verify the SHA-256 of the image. Without it, flashing fails if
+	// there is no checksum to compare with
+	SkipVerify bool
+	// Block device or regular file where the image is written
+	Target   string
+	CacheDir string
+	// Skip the confirmation before overwriting the target
+	Yes bool
+	// Boot setup executed after flashing the image, nil to skip it. If its
+	// BootPath is set, the setup runs there instead of mounting the boot
+	// partition of the target (which requires root).
+	Boot *boot.BootArgs
+}
+
+func NewManager() *imageManager {
+	return &imageManager{
+		log: logging.Get(),
+	}
+}
+
+type imageManager struct {
+	log *zerolog.Logger
+}
+
+type ImageResult struct {
+	// The boot setup could not be executed automatically, the boot command
+	// must be executed after mounting the boot partition
+	NeedManualBoot bool
+}
+
+func (m *imageManager) Flash(args ImageArgs, confirm func(target string) bool) (ImageResult, error) {
+	result := ImageResult{NeedManualBoot: false}
+
+	if err := checkTarget(args.Target); err != nil {
+		return result, err
+	}
+
+	imagePath, cached, err := m.getImage(args)
+	if err != nil {
+		return result, err
+	}
+
+	err = m.verifyImage(args, imagePath, cached)
+	if err != nil {
+		return result, err
+	}
+
+	if needsConfirmation(args.Target) && !args.Yes && !confirm(args.Target) {
+		return result, errors.New("aborted by the user")
+	}
+
+	err = m.writeImage(imagePath, args.Target)
+	if err != nil {
+		return result, err
+	}
+
+	if args.Boot == nil {
+		return result, nil
+	}
+
+	if len(args.Boot.BootPath) > 0 {
+		return result, boot.NewBootManager().Setup(*args.Boot)
+	}
+
+	err = setupBootPartition(args.Target, *args.Boot)
+	if errors.Is(err, errMountNotSupported) {
+		result.NeedManualBoot = true
+		return result, nil
+	}
+	return result, err
+}
+
+// getImage returns the local path of the image, downloading it to the cache
+// if the source is a URL. The boolean is true if the image was already cached.
+func (m *imageManager) getImage(args ImageArgs) (string, bool, error) {
+	if !isURL(args.Source) {
+		if _, err := os.Stat(args.Source); err != nil {
+			return "", false, fmt.Errorf("image not found: %w", err)
+		}
+		return args.Source, false, nil
+	}
+
+	info.Title("Downloading image")
+
+	imageURL, err := url.Parse(args.Source)
+	if err != nil {
+		info.Fail()
+		return "", false, fmt.Errorf("invalid image url: %w", err)
+	}
+
+	err = os.MkdirAll(args.CacheDir, 0755)
+	if err != nil {
+		info.Fail()
+		return "", false, fmt.Errorf("error creating cache directory: %w", err)
+	}
+
+	imagePath := filepath.Join(args.CacheDir, path.Base(imageURL.Path))
+	if _, err := os.Stat(imagePath); err == nil {
+		m.log.Debug().Str("path", imagePath).Msg("Using cached image")
+		info.Skipped()
+		return imagePath, true, nil
+	}
+
+	// Download to a temporary file, so an interrupted download is not cached
+	tmpPath := imagePath + ".part"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		info.Fail()
+		return "", false, fmt.Errorf("error creating image file: %w", err)
+	}
+	defer os.Remove(tmpPath)
+
+	err = requests.URL(args.Source).
+		Handle(func(res *http.Response) error {
+			defer res.Body.Close()
+			_, err := io.Copy(file, newProgressReader(res.Body, res.ContentLength, "Downloading image"))
+			return err
+		}).
+		Fetch(context.Background())
+	file.Close()
+	if err != nil {
+		info.Fail()
+		return "", false, fmt.Errorf("error downloading image from %s: %w", args.Source, err)
+	}
+
+	err = os.Rename(tmpPath, imagePath)
+	if err != nil {
+		info.Fail()
+		return "", false, fmt.Errorf("error saving image in cache: %w", err)
+	}
+
+	info.Ok()
+	return imagePath, false, nil
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyImage checks the SHA-256 of the image. A cached image that doesn't
+// match is removed and downloaded again, so a corrupt download is not reused.
+func (m *imageManager) verifyImage(args ImageArgs, imagePath string, cached bool) error {
+	info.Title("Verifying SHA-256")
+	if args.SkipVerify {
+		info.Skipped()
+		return nil
+	}
+
+	expected, err := m.expectedChecksum(args)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	err = verifyChecksum(imagePath, expected)
+	if errors.Is(err, errChecksumMismatch) && cached {
+		info.Fail()
+		m.log.Warn().Err(err).Msg("Cached image is corrupt, downloading it again")
+		err = os.Remove(imagePath)
+		if err != nil {
+			return fmt.Errorf("error removing cached image: %w", err)
+		}
+		imagePath, _, err = m.getImage(args)
+		if err != nil {
+			return err
+		}
+
+		info.Title("Verifying SHA-256")
+		err = verifyChecksum(imagePath, expected)
+	}
+	if err != nil {
+		info.Fail()
+		return err
+	}
+
+	info.Ok()
+	return nil
+}
+
+// expectedChecksum returns the SHA-256 passed by the user or, for URLs, the
+// one published in <URL>.sha256
+func (m *imageManager) expectedChecksum(args ImageArgs) (string, error) {
+	expected := strings.ToLower(strings.TrimSpace(args.SHA256))
+	if expected == "" && isURL(args.Source) {
+		var body string
+		err := requests.URL(args.Source + ".sha256").ToString(&body).Fetch(context.Background())
+		if err != nil {
+			m.log.Warn().Err(err).Msg("Checksum file not found")
+		}
+		// Format: <checksum>  <filename>
+		fields := strings.Fields(body)
+		if len(fields) > 0 {
+			expected = strings.ToLower(fields[0])
+		}
+	}
+	if expected == "" {
+		return "", errors.New("no SHA-256 available for the image, pass it with --sha256 or use --skip-verify")
+	}
+	return expected, nil
+}
+
+func verifyChecksum(imagePath, expected string) error {
+	file, err := os.Open(imagePath)
+	if err != nil {
+		return fmt.Errorf("error opening image: %w", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return fmt.Errorf("error reading image: %w", err)
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if actual != expected {
+		return fmt.Errorf("%w for %s: expected %s, got %s", errChecksumMismatch, imagePath, expected, actual)
+	}
+	return nil
+}
+
+// writeImage decompresses the image (if needed) while writing it to target
+func (m *imageManager) writeImage(imagePath, target string) error {
+	info.Title("Writing image to %s", target)
+
+	file, err := os.Open(imagePath)
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("error opening image: %w", err)
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("error reading image: %w", err)
+	}
+
+	// Progress is measured with the compressed size, as the decompressed one is unknown
+	var reader io.Reader = bufio.NewReader(newProgressReader(file, stat.Size(), fmt.Sprintf("Writing image to %s", target)))
+	switch {
+	case strings.HasSuffix(imagePath, ".xz"):
+		reader, err = xz.NewReader(reader)
+	case strings.HasSuffix(imagePath, ".gz"):
+		reader, err = gzip.NewReader(reader)
+	}
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("error decompressing image: %w", err)
+	}
+
+	flags := os.O_WRONLY
+	if !isBlockDevice(target) {
+		flags |= os.O_CREATE | os.O_TRUNC
+	}
+	output, err := os.OpenFile(target, flags, 0644)
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("error opening target: %w", err)
+	}
+	defer output.Close()
+
+	_, err = io.CopyBuffer(output, reader, make([]byte, 4*1024*1024))
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("error writing image: %w", err)
+	}
+
+	err = output.Sync()
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("error syncing target: %w", err)
+	}
+
+	info.Ok()
+	return nil
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
@@ -0,0 +1,160 @@
+package image
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/sralloza/rpi-provisioner/pkg/boot"
+	"github.com/ulikunitz/xz"
+)
+
+func newTestManager() *imageManager {
+	log := zerolog.Nop()
+	return &imageManager{log: &log}
+}
+
+// writeFixture writes content to dir/name, compressed according to its
+// extension, and returns its path and SHA-256
+func writeFixture(t *testing.T, dir, name string, content []byte) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	var writer io.WriteCloser
+	switch filepath.Ext(name) {
+	case ".xz":
+		xzWriter, err := xz.NewWriter(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writer = xzWriter
+	case ".gz":
+		writer = gzip.NewWriter(&buf)
+	}
+	if writer != nil {
+		if _, err := writer.Write(content); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		buf.Write(content)
+	}
+
+	imagePath := filepath.Join(dir, name)
+	if err := os.WriteFile(imagePath, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	return imagePath, hex.EncodeToString(sum[:])
+}
+
+func noConfirm(target string) bool {
+	return false
+}
+
+func TestFlashToFile(t *testing.T) {
+	content := bytes.Repeat([]byte("raspberry pi image\x00"), 64*1024)
+	for _, name := range []string{"test.img", "test.img.xz", "test.img.gz"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			source, checksum := writeFixture(t, dir, name, content)
+			target := filepath.Join(dir, "target.img")
+
+			args := ImageArgs{Source: source, SHA256: checksum, Target: target}
+			if _, err := newTestManager().Flash(args, noConfirm); err != nil {
+				t.Fatal(err)
+			}
+
+			written, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(written, content) {
+				t.Errorf("target has %d bytes, expected the %d bytes of the image", len(written), len(content))
+			}
+		})
+	}
+}
+
+func TestFlashChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	source, _ := writeFixture(t, dir, "test.img.xz", []byte("image"))
+	target := filepath.Join(dir, "target.img")
+
+	args := ImageArgs{Source: source, SHA256: hex.EncodeToString(make([]byte, 32)), Target: target}
+	_, err := newTestManager().Flash(args, noConfirm)
+	if !errors.Is(err, errChecksumMismatch) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("target written after a checksum mismatch: %v", err)
+	}
+}
+
+func TestFlashWithoutChecksum(t *testing.T) {
+	dir := t.TempDir()
+	source, _ := writeFixture(t, dir, "test.img", []byte("image"))
+	target := filepath.Join(dir, "target.img")
+
+	args := ImageArgs{Source: source, Target: target}
+	if _, err := newTestManager().Flash(args, noConfirm); err == nil {
+		t.Fatal("flashed without a checksum")
+	}
+
+	args.SkipVerify = true
+	if _, err := newTestManager().Flash(args, noConfirm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFlashExistingTargetNeedsConfirmation(t *testing.T) {
+	dir := t.TempDir()
+	source, checksum := writeFixture(t, dir, "test.img", []byte("image"))
+	target := filepath.Join(dir, "target.img")
+	if err := os.WriteFile(target, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := ImageArgs{Source: source, SHA256: checksum, Target: target}
+	if _, err := newTestManager().Flash(args, noConfirm); err == nil {
+		t.Fatal("existing target overwritten without confirmation")
+	}
+	if written, _ := os.ReadFile(target); string(written) != "data" {
+		t.Errorf("target changed without confirmation: %q", written)
+	}
+}
+
+func TestFlashWithBootPath(t *testing.T) {
+	dir := t.TempDir()
+	source, checksum := writeFixture(t, dir, "test.img.xz", []byte("image"))
+	bootPath := t.TempDir()
+	cmdLine := "console=tty1 root=PARTUUID=x rootwait\n"
+	if err := os.WriteFile(filepath.Join(bootPath, "cmdline.txt"), []byte(cmdLine), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	args := ImageArgs{
+		Source: source,
+		SHA256: checksum,
+		Target: filepath.Join(dir, "target.img"),
+		Boot:   &boot.BootArgs{BootPath: bootPath, Hostname: "test"},
+	}
+	result, err := newTestManager().Flash(args, noConfirm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NeedManualBoot {
+		t.Error("manual boot setup requested with a boot path")
+	}
+	if _, err := os.Stat(filepath.Join(bootPath, "firstrun.sh")); err != nil {
+		t.Errorf("boot setup not executed in the boot path: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+package image
+
+import (
+	"fmt"
+	"io"
+)
+
+// progressReader prints the percentage of bytes read after the step title
+type progressReader struct {
+	reader  io.Reader
+	total   int64
+	read    int64
+	title   string
+	percent int
+}
+
+func newProgressReader(reader io.Reader, total int64, title string) *progressReader {
+	return &progressReader{reader: reader, total: total, title: title, percent: -1}
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.reader.Read(buf)
+	p.read += int64(n)
+	if p.total > 0 {
+		percent := int(p.read * 100 / p.total)
+		if percent != p.percent {
+			p.percent = percent
+			fmt.Printf("\r%s... %3d%% ", p.title, percent)
+		}
+		if err == io.EOF {
+			// Leave the title alone, so the step result is printed after it
+			fmt.Printf("\r%s... ", p.title)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,133 @@
+package image
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/boot"
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+)
+
+var errMountNotSupported = errors.New("mounting the boot partition is only supported on linux")
+
+// checkTarget refuses to write to a device that has mounted partitions
+func checkTarget(target string) error {
+	if !isBlockDevice(target) {
+		return nil
+	}
+
+	file, err := os.Open("/proc/mounts")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading mounted filesystems: %w", err)
+	}
+	defer file.Close()
+
+	device, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %w", target, err)
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !isPartitionOf(fields[0], device) {
+			continue
+		}
+		return fmt.Errorf("%s is mounted in %s, unmount it before writing the image", fields[0], fields[1])
+	}
+	return scanner.Err()
+}
+
+// needsConfirmation returns true if writing to target destroys existing data
+func needsConfirmation(target string) bool {
+	_, err := os.Stat(target)
+	return err == nil
+}
+
+func isBlockDevice(path string) bool {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return fileInfo.Mode()&os.ModeDevice != 0
+}
+
+// setupBootPartition mounts the first partition of target and runs the boot
+// setup on it. Regular files are attached to a loop device first.
+func setupBootPartition(target string, args boot.BootArgs) error {
+	if runtime.GOOS != "linux" {
+		return errMountNotSupported
+	}
+
+	info.Title("Mounting boot partition")
+
+	device := target
+	if !isBlockDevice(target) {
+		output, err := exec.Command("losetup", "--find", "--show", "--partscan", target).Output()
+		if err != nil {
+			info.Fail()
+			return fmt.Errorf("error attaching %s to a loop device: %w", target, err)
+		}
+		device = strings.TrimSpace(string(output))
+		defer exec.Command("losetup", "--detach", device).Run()
+	} else {
+		// Make the kernel read the new partition table
+		exec.Command("partprobe", device).Run()
+	}
+
+	mountPath, err := os.MkdirTemp("", "rpi-provisioner-boot-")
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("error creating mount directory: %w", err)
+	}
+	defer os.Remove(mountPath)
+
+	output, err := exec.Command("mount", partitionPath(device, 1), mountPath).CombinedOutput()
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("error mounting boot partition: %w (%s)", err, strings.TrimSpace(string(output)))
+	}
+	info.Ok()
+
+	args.BootPath = mountPath
+	setupErr := boot.NewBootManager().Setup(args)
+
+	info.Title("Unmounting boot partition")
+	output, err = exec.Command("umount", mountPath).CombinedOutput()
+	if err != nil {
+		info.Fail()
+		if setupErr != nil {
+			return setupErr
+		}
+		return fmt.Errorf("error unmounting boot partition: %w (%s)", err, strings.TrimSpace(string(output)))
+	}
+	info.Ok()
+	return setupErr
+}
+
+// isPartitionOf returns true if path is device or one of its partitions
+func isPartitionOf(path, device string) bool {
+	suffix, found := strings.CutPrefix(path, device)
+	if !found {
+		return false
+	}
+	return strings.Trim(strings.TrimPrefix(suffix, "p"), "0123456789") == ""
+}
+
+// partitionPath returns the device of a partition: /dev/sda1, /dev/mmcblk0p1, /dev/loop0p1
+func partitionPath(device string, number int) string {
+	last := device[len(device)-1]
+	if last >= '0' && last <= '9' {
+		return fmt.Sprintf("%sp%d", device, number)
+	}
+	return fmt.Sprintf("%s%d", device, number)
+}
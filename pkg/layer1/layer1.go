@@ -6,14 +6,24 @@ import (
 	"strings"
 
 	"github.com/sralloza/rpi-provisioner/pkg/authorizedkeys"
+	"github.com/sralloza/rpi-provisioner/pkg/firewall"
 	"github.com/sralloza/rpi-provisioner/pkg/info"
 	"github.com/sralloza/rpi-provisioner/pkg/networking"
+	"github.com/sralloza/rpi-provisioner/pkg/secrets"
 	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+	"github.com/sralloza/rpi-provisioner/pkg/sshd"
+	"github.com/sralloza/rpi-provisioner/pkg/sudoers"
 )
 
 type Layer1Args struct {
-	LoginUser        string
-	LoginPassword    string
+	LoginUser     string
+	LoginPassword string
+	// Login with the ssh key instead of the password. The password is still
+	// used by sudo if the login user doesn't have passwordless sudo.
+	LoginUseSSHKey bool
+	// Private key used by the login user (with LoginUseSSHKey) and by the
+	// deployer, defaults to ~/.ssh/id_rsa
+	KeyPath          string
 	DeployerUser     string
 	DeployerPassword string
 	RootPassword     string
@@ -21,6 +31,14 @@ type Layer1Args struct {
 	Port             int
 	KeysUri          string
 	IpAddress        net.IP
+	SSHD             sshd.Profile
+	// Commands the deployer can run with sudo, empty for all
+	SudoCommands        []string
+	SudoRequirePassword bool
+	// Action applied to the login user: disable (default), lock or delete
+	LoginUserAction string
+	// Firewall applied after hardening sshd, nil to skip it
+	Firewall *firewall.Rules
 }
 
 func NewManager() *layer1Manager {
@@ -29,41 +47,82 @@ func NewManager() *layer1Manager {
 
 type layer1Manager struct {
 	conn ssh.SSHConnection
+	// Password used by sudo in the server, empty for passwordless sudo
+	sudoPassword string
+	undo         []undoAction
+	// Connection of the deployer, used after locking or deleting the login user
+	deployerConn *ssh.SSHConnection
+	// Users whose password was set (and not rolled back)
+	passwordsSet map[string]bool
 }
 
 type Layer1Result struct {
 	NeedRestartForDHCPCleanup bool
-	// SSH Connection error, layer 1 should be provisioned
-	ConnectionError           bool
+	// The login user can't login but the deployer can, layer 1 was already provisioned
+	AlreadyProvisioned bool
+	// Effective value of the sshd settings managed by layer1 (sshd -T)
+	SSHDSettings []string
+	// Users whose password was set in the server, also filled on errors
+	PasswordsSet []string
 }
 
 func (m *layer1Manager) Provision(args Layer1Args) (Layer1Result, error) {
 	result := Layer1Result{
 		NeedRestartForDHCPCleanup: false,
-		ConnectionError:           false,
+		AlreadyProvisioned:        false,
 	}
 	address := fmt.Sprintf("%s:%d", args.Host, args.Port)
 
 	m.conn = ssh.SSHConnection{
 		Password:  args.LoginPassword,
-		UseSSHKey: false,
+		UseSSHKey: args.LoginUseSSHKey,
+		KeyPath:   args.KeyPath,
 	}
 
 	info.Title("Connecting to %s", address)
+	// Checked before connecting as the login user, as it may still be able to
+	// login with its ssh key after being disabled
+	if m.alreadyProvisioned(args) {
+		info.Skipped()
+		result.AlreadyProvisioned = true
+		return result, nil
+	}
 	err := m.conn.Connect(args.LoginUser, address)
 	if err != nil {
-		if strings.Contains(err.Error(), "no supported methods remain") {
-			info.Skipped()
-			result.ConnectionError = true
-			return result, nil
-		}
 		info.Fail()
 		return result, fmt.Errorf("SSH connection error: %w", err)
 	}
 	info.Ok()
 	defer m.conn.Close()
+	defer func() {
+		if m.deployerConn != nil {
+			m.deployerConn.Close()
+		}
+	}()
+
+	info.Title("Checking sudo access")
+	if _, _, err := m.conn.Run("sudo -n true"); err == nil {
+		m.sudoPassword = ""
+		info.Ok()
+	} else if len(args.LoginPassword) > 0 {
+		m.sudoPassword = args.LoginPassword
+		info.Ok()
+	} else {
+		info.Fail()
+		return result, fmt.Errorf("%s needs a password to use sudo, pass --login-password", args.LoginUser)
+	}
 
-	return m.provisionLayer1(args)
+	m.passwordsSet = map[string]bool{}
+	result, err = m.provisionLayer1(args)
+	if err != nil && len(m.undo) > 0 {
+		if rollbackErr := m.rollback(); rollbackErr != nil {
+			err = fmt.Errorf("%w (%s)", err, rollbackErr)
+		}
+	}
+	for user := range m.passwordsSet {
+		result.PasswordsSet = append(result.PasswordsSet, user)
+	}
+	return result, err
 }
 
 func (m *layer1Manager) provisionLayer1(args Layer1Args) (Layer1Result, error) {
@@ -71,12 +130,20 @@ func (m *layer1Manager) provisionLayer1(args Layer1Args) (Layer1Result, error) {
 		NeedRestartForDHCPCleanup: false,
 	}
 
+	info.Title("Backing up server state")
+	if err := m.backupState(args); err != nil {
+		info.Fail()
+		return result, err
+	}
+	info.Ok()
+
 	info.Title("Creating deployer group")
 	if provisioned, err := m.createDeployerGroup(args); err != nil {
 		info.Fail()
 		return result, err
 	} else if provisioned {
 		info.Ok()
+		m.pushUndo("deployer group", func() error { return m.deleteDeployerGroup(args) })
 	} else {
 		info.Skipped()
 	}
@@ -87,6 +154,7 @@ func (m *layer1Manager) provisionLayer1(args Layer1Args) (Layer1Result, error) {
 		return result, err
 	} else if provisioned {
 		info.Ok()
+		m.pushUndo("sudoers", func() error { return m.restoreSudoers(args) })
 	} else {
 		info.Skipped()
 	}
@@ -97,8 +165,19 @@ func (m *layer1Manager) provisionLayer1(args Layer1Args) (Layer1Result, error) {
 		return result, err
 	} else if provisioned {
 		info.Ok()
+		m.pushUndo("deployer user", func() error { return m.deleteDeployerUser(args) })
 	} else {
 		info.Skipped()
+
+		info.Title("Provisioning deployer password")
+		if provisioned, err := m.updateDeployerPassword(args); err != nil {
+			info.Fail()
+			return result, err
+		} else if provisioned {
+			info.Ok()
+		} else {
+			info.Skipped()
+		}
 	}
 
 	if len(args.RootPassword) > 0 {
@@ -108,6 +187,7 @@ func (m *layer1Manager) provisionLayer1(args Layer1Args) (Layer1Result, error) {
 			return result, err
 		} else if provisioned {
 			info.Ok()
+			m.pushUndo("root password", func() error { return m.restorePassword("root", "root-shadow") })
 		} else {
 			info.Skipped()
 		}
@@ -116,7 +196,7 @@ func (m *layer1Manager) provisionLayer1(args Layer1Args) (Layer1Result, error) {
 	info.Title("Provisioning SSH keys")
 	if provisioned, err := authorizedkeys.UploadsshKeys(m.conn, authorizedkeys.UploadsshKeysArgs{
 		User:     args.DeployerUser,
-		Password: args.LoginPassword,
+		Password: m.sudoPassword,
 		Group:    args.DeployerUser,
 		KeysUri:  args.KeysUri,
 	}); err != nil {
@@ -129,28 +209,112 @@ func (m *layer1Manager) provisionLayer1(args Layer1Args) (Layer1Result, error) {
 	}
 
 	info.Title("Configuring SSHD")
-	if provisioned, err := m.setupsshdConfig(args); err != nil {
+	sshdChanged, err := m.setupsshdConfig(args)
+	if err != nil {
 		info.Fail()
 		return result, err
-	} else if provisioned {
+	} else if sshdChanged {
 		info.Ok()
+		m.pushUndo("sshd config", m.restoresshdConfig)
 	} else {
 		info.Skipped()
 	}
 
-	info.Title("Disabling loginUser login")
-	if provisioned, err := m.disableLoginUser(args); err != nil {
+	// The login user is only disabled if the deployer can login with the ssh
+	// keys, otherwise the access to the server would be lost
+	info.Title("Verifying deployer login")
+	if err := m.verifyDeployerLogin(args); err != nil {
 		info.Fail()
 		return result, err
-	} else if provisioned {
+	}
+	info.Ok()
+
+	if sshdChanged {
+		info.Title("Reloading SSHD")
+		settings, err := m.reloadsshd(args)
+		if err != nil {
+			info.Fail()
+			return result, err
+		}
+		info.Ok()
+		result.SSHDSettings = settings
+
+		// The new settings (like AllowUsers or the ciphers) must not lock
+		// the deployer out before the login user is disabled
+		info.Title("Verifying deployer login with the new sshd config")
+		if err := m.verifyDeployerLogin(args); err != nil {
+			info.Fail()
+			return result, err
+		}
 		info.Ok()
-	} else {
-		info.Skipped()
 	}
 
+	if args.Firewall != nil {
+		// The firewall prints its own steps
+		firewallManager := firewall.NewManager(m.conn, m.sudoPassword)
+		address := fmt.Sprintf("%s:%d", args.Host, args.Firewall.SSHPort)
+		deployerConn := ssh.SSHConnection{UseSSHKey: true, KeyPath: args.KeyPath}
+		err := firewallManager.Apply(*args.Firewall, func() error {
+			return deployerConn.CheckLogin(args.DeployerUser, address)
+		})
+		if err != nil {
+			return result, err
+		}
+		// The connection may change before the undo actions are run
+		m.pushUndo("firewall", func() error { return firewall.NewManager(m.conn, m.sudoPassword).Revert() })
+	}
+
+	switch args.LoginUserAction {
+	case LoginUserLock, LoginUserDelete:
+		info.Title("Connecting as %s", args.DeployerUser)
+		if err := m.switchToDeployer(args); err != nil {
+			info.Fail()
+			return result, err
+		}
+		info.Ok()
+	}
+
+	switch args.LoginUserAction {
+	case LoginUserLock:
+		info.Title("Locking loginUser")
+		if provisioned, err := m.lockLoginUser(args); err != nil {
+			info.Fail()
+			return result, err
+		} else if provisioned {
+			info.Ok()
+		} else {
+			info.Skipped()
+		}
+	case LoginUserDelete:
+		// Can't be undone, it is the last step of the transaction
+		info.Title("Deleting loginUser")
+		if provisioned, err := m.deleteLoginUser(args); err != nil {
+			info.Fail()
+			return result, err
+		} else if provisioned {
+			info.Ok()
+		} else {
+			info.Skipped()
+		}
+	default:
+		info.Title("Disabling loginUser login")
+		if provisioned, err := m.disableLoginUser(args); err != nil {
+			info.Fail()
+			return result, err
+		} else if provisioned {
+			info.Ok()
+			m.pushUndo("login user", func() error { return m.restoreLoginUser(args) })
+		} else {
+			info.Skipped()
+		}
+	}
+
+	// The server is hardened, the static IP is not part of the transaction
+	m.undo = nil
+
 	if len(args.IpAddress) > 0 {
 		info.Title("Provisioning static IP %s", args.IpAddress)
-		networkResult, err := networking.SetupNetworking(m.conn, args.IpAddress, args.LoginPassword, args.Host)
+		networkResult, err := networking.SetupNetworking(m.conn, args.IpAddress, m.sudoPassword, args.Host)
 		result.NeedRestartForDHCPCleanup = networkResult.NeedRestartForDHCPCleanup
 		if err != nil {
 			info.Fail()
@@ -173,35 +337,31 @@ func (m *layer1Manager) createDeployerGroup(args Layer1Args) (bool, error) {
 		return false, nil
 	}
 	groupaddCmd := fmt.Sprintf("groupadd %s", args.DeployerUser)
-	stdout, stderr, err := m.conn.RunSudoPassword(groupaddCmd, args.LoginPassword)
+	stdout, stderr, err := m.conn.RunSudoPassword(groupaddCmd, m.sudoPassword)
 	if err != nil {
 		return false, fmt.Errorf("error creating deployer group: %s [%s %s]", err, stdout, stderr)
 	}
 	return true, nil
 }
 
-func (m *layer1Manager) provisionSudoer(args Layer1Args) (bool, error) {
-	initialSudoers, _, err := m.conn.RunSudoPassword("cat /etc/sudoers", args.LoginPassword)
+func (m *layer1Manager) deleteDeployerGroup(args Layer1Args) error {
+	_, _, err := m.conn.RunSudoPassword(fmt.Sprintf("groupdel %s", args.DeployerUser), m.sudoPassword)
 	if err != nil {
-		return false, fmt.Errorf("error getting sudoers info: %w", err)
+		return fmt.Errorf("error deleting deployer group: %w", err)
 	}
-	initialSudoers = strings.Trim(initialSudoers, "\n\r")
+	return nil
+}
 
-	extraSudoer := fmt.Sprintf("%s ALL=(ALL) NOPASSWD: ALL", args.DeployerUser)
-	if strings.Contains(initialSudoers, extraSudoer) {
-		return false, nil
-	}
-	_, _, err = m.conn.RunSudoPassword("cp /etc/sudoers /etc/sudoers.bkp", args.LoginPassword)
-	if err != nil {
-		return false, fmt.Errorf("error creating sudoers backup: %w", err)
-	}
+func (m *layer1Manager) provisionSudoer(args Layer1Args) (bool, error) {
+	return sudoers.NewManager(m.conn, m.sudoPassword).Apply(m.sudoRule(args))
+}
 
-	sudoersCmd := fmt.Sprintf("echo \"\n%s\n\" >> /etc/sudoers", extraSudoer)
-	_, _, err = m.conn.RunSudoPassword(sudoersCmd, args.LoginPassword)
-	if err != nil {
-		return false, fmt.Errorf("error updating sudoers: %w", err)
+func (m *layer1Manager) sudoRule(args Layer1Args) sudoers.Rule {
+	return sudoers.Rule{
+		User:            args.DeployerUser,
+		Commands:        args.SudoCommands,
+		RequirePassword: args.SudoRequirePassword,
 	}
-	return true, nil
 }
 
 func (m *layer1Manager) createDeployerUser(args Layer1Args) (bool, error) {
@@ -212,31 +372,30 @@ func (m *layer1Manager) createDeployerUser(args Layer1Args) (bool, error) {
 
 	useraddCmd := fmt.Sprintf("useradd -m -c 'deployer' -s /bin/bash -g '%s' ", args.DeployerUser)
 	useraddCmd += args.DeployerUser
-	_, _, err = m.conn.RunSudoPassword(useraddCmd, args.LoginPassword)
+	_, _, err = m.conn.RunSudoPassword(useraddCmd, m.sudoPassword)
 	if err != nil {
 		return false, fmt.Errorf("error executing useradd: %w", err)
 	}
 
-	chpasswdCmd := fmt.Sprintf("echo %s:%s | chpasswd", args.DeployerUser, args.DeployerPassword)
-	_, _, err = m.conn.RunSudoPassword(chpasswdCmd, args.LoginPassword)
+	err = m.setPassword(args.DeployerUser, args.DeployerPassword)
 	if err != nil {
 		return false, fmt.Errorf("error setting deployer password: %w", err)
 	}
 
 	usermodCmd := fmt.Sprintf("usermod -a -G %s %s", args.DeployerUser, args.DeployerUser)
-	_, _, err = m.conn.RunSudoPassword(usermodCmd, args.LoginPassword)
+	_, _, err = m.conn.RunSudoPassword(usermodCmd, m.sudoPassword)
 	if err != nil {
 		return false, fmt.Errorf("error setting deployer group: %w", err)
 	}
 
 	mkdirsshCmd := fmt.Sprintf("mkdir /home/%s/.ssh", args.DeployerUser)
-	_, _, err = m.conn.RunSudoPassword(mkdirsshCmd, args.LoginPassword)
+	_, _, err = m.conn.RunSudoPassword(mkdirsshCmd, m.sudoPassword)
 	if err != nil {
 		return false, fmt.Errorf("error setting deployer ssh folder: %w", err)
 	}
 
 	chownCmd := fmt.Sprintf("chown -R %s:%s /home/%s", args.DeployerUser, args.DeployerUser, args.DeployerUser)
-	_, _, err = m.conn.RunSudoPassword(chownCmd, args.LoginPassword)
+	_, _, err = m.conn.RunSudoPassword(chownCmd, m.sudoPassword)
 	if err != nil {
 		return false, fmt.Errorf("error changing deployer's home dir: %w", err)
 	}
@@ -244,77 +403,149 @@ func (m *layer1Manager) createDeployerUser(args Layer1Args) (bool, error) {
 	return true, nil
 }
 
+// updateDeployerPassword sets the password of an existing deployer user if it
+// doesn't match the current one
+func (m *layer1Manager) updateDeployerPassword(args Layer1Args) (bool, error) {
+	stdout, _, err := m.conn.RunSudoPassword("getent shadow "+args.DeployerUser, m.sudoPassword)
+	if err != nil {
+		return false, fmt.Errorf("error reading deployer password: %w", err)
+	}
+	// name:hash:...
+	fields := strings.Split(strings.TrimSpace(stdout), ":")
+	if len(fields) > 1 && secrets.CheckPassword(args.DeployerPassword, fields[1]) {
+		return false, nil
+	}
+
+	err = m.setPassword(args.DeployerUser, args.DeployerPassword)
+	if err != nil {
+		return false, fmt.Errorf("error setting deployer password: %w", err)
+	}
+	return true, nil
+}
+
+func (m *layer1Manager) deleteDeployerUser(args Layer1Args) error {
+	_, _, err := m.conn.RunSudoPassword(fmt.Sprintf("userdel -r %s", args.DeployerUser), m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("error deleting deployer user: %w", err)
+	}
+	delete(m.passwordsSet, args.DeployerUser)
+	return nil
+}
+
 func (m *layer1Manager) setRootPassword(args Layer1Args) (bool, error) {
-	chpasswdCmd := fmt.Sprintf("echo root:%s | chpasswd", args.RootPassword)
-	_, _, err := m.conn.RunSudoPassword(chpasswdCmd, args.LoginPassword)
+	err := m.setPassword("root", args.RootPassword)
 	if err != nil {
 		return false, fmt.Errorf("error setting root password: %w", err)
 	}
 	return true, nil
 }
 
+// setPassword hashes the password locally, so the plain password is not
+// visible in the process list of the server
+func (m *layer1Manager) setPassword(user, password string) error {
+	hash, err := secrets.HashPassword(password)
+	if err != nil {
+		return err
+	}
+	// The hash is double quoted, so $ must be escaped
+	chpasswdCmd := fmt.Sprintf("echo \"%s:%s\" | chpasswd -e", user, strings.ReplaceAll(hash, "$", "\\$"))
+	_, stderr, err := m.conn.RunSudoPassword(chpasswdCmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("%w [%s]", err, strings.TrimSpace(stderr))
+	}
+	if m.passwordsSet != nil {
+		m.passwordsSet[user] = true
+	}
+	return nil
+}
+
 func (m *layer1Manager) setupsshdConfig(args Layer1Args) (bool, error) {
-	config := "/etc/ssh/sshd_config"
-	changes := []string{"UsePAM yes", "PermitRootLogin yes", "PasswordAuthentication yes"}
+	return sshd.NewManager(m.conn, m.sudoPassword).Apply(args.SSHD)
+}
 
-	catCmd := fmt.Sprintf("cat %s", config)
-	data, _, err := m.conn.RunSudoPassword(catCmd, args.LoginPassword)
+// reloadsshd applies the sshd config and returns the effective value of the
+// managed settings
+func (m *layer1Manager) reloadsshd(args Layer1Args) ([]string, error) {
+	manager := sshd.NewManager(m.conn, m.sudoPassword)
+	err := manager.Reload()
 	if err != nil {
-		return false, fmt.Errorf("error getting current sshd config: %w", err)
+		return nil, err
 	}
 
-	currentConfig := string(data)
-	needChanges := false
-	for _, change := range changes {
-		if strings.Contains(currentConfig, change) {
-			needChanges = true
-		}
+	keywords := []string{}
+	for _, directive := range args.SSHD.Directives() {
+		keywords = append(keywords, directive.Keyword)
 	}
-	if !needChanges {
-		return false, nil
+	effective, err := manager.Effective(keywords)
+	if err != nil {
+		return nil, err
 	}
 
-	backupCmd := fmt.Sprintf("cp %s %s.backup", config, config)
-	_, _, err = m.conn.RunSudoPassword(backupCmd, args.LoginPassword)
-	if err != nil {
-		return false, fmt.Errorf("error creating backup of sshd config: %w", err)
+	settings := []string{}
+	for _, directive := range effective {
+		settings = append(settings, directive.Keyword+" "+directive.Value())
 	}
+	return settings, nil
+}
 
-	usePamCmd := fmt.Sprintf("sed -i \"s/^#*UsePAM yes/UsePAM no/\" %s", config)
-	_, _, err = m.conn.RunSudoPassword(usePamCmd, args.LoginPassword)
-	if err != nil {
-		return false, fmt.Errorf("error resticting sshd PAM use: %w", err)
+// alreadyProvisioned returns true if the deployer can login and use sudo and
+// the login user was disabled, locked or deleted by a previous execution
+func (m *layer1Manager) alreadyProvisioned(args Layer1Args) bool {
+	if m.verifyDeployerLogin(args) != nil {
+		return false
 	}
 
-	permitRootLoginCmd := fmt.Sprintf("sed -i \"s/^#*PermitRootLogin yes/PermitRootLogin no/\" %s", config)
-	_, _, err = m.conn.RunSudoPassword(permitRootLoginCmd, args.LoginPassword)
+	conn := ssh.SSHConnection{UseSSHKey: true, KeyPath: args.KeyPath}
+	err := conn.Connect(args.DeployerUser, fmt.Sprintf("%s:%d", args.Host, args.Port))
 	if err != nil {
-		return false, fmt.Errorf("error disabling ssh root login: %w", err)
+		return false
 	}
+	defer conn.Close()
 
-	passwordAuthCmd := fmt.Sprintf("sed -i \"s/^#*PasswordAuthentication yes/PasswordAuthentication no/\" %s", config)
-	_, _, err = m.conn.RunSudoPassword(passwordAuthCmd, args.LoginPassword)
+	// getent fails if the user was deleted
+	stdout, _, err := conn.Run(fmt.Sprintf("getent passwd %s || true", args.LoginUser))
 	if err != nil {
-		return false, fmt.Errorf("error disabling ssh password auth: %w", err)
+		return false
 	}
+	// name:password:uid:gid:comment:home:shell
+	fields := strings.Split(strings.TrimSpace(stdout), ":")
+	return len(fields) < 7 || strings.HasSuffix(fields[6], "nologin")
+}
 
-	_, _, err = m.conn.RunSudoPassword("service ssh reload", args.LoginPassword)
+// verifyDeployerLogin opens a new connection as the deployer user with the
+// ssh key and checks that it can use sudo
+func (m *layer1Manager) verifyDeployerLogin(args Layer1Args) error {
+	conn := ssh.SSHConnection{UseSSHKey: true, KeyPath: args.KeyPath}
+	address := fmt.Sprintf("%s:%d", args.Host, args.Port)
+	err := conn.Connect(args.DeployerUser, address)
 	if err != nil {
-		return false, fmt.Errorf("error reloading ssh service: %w", err)
+		return fmt.Errorf("deployer can't login with the ssh key, check --keys-uri: %w", err)
 	}
+	defer conn.Close()
 
-	return true, nil
+	// sudo -l lists the allowed commands, so it also works with restricted
+	// rules. The password is written to the stdin of sudo.
+	var stderr string
+	if args.SudoRequirePassword {
+		_, stderr, err = conn.RunStdin("sudo -S -l", args.DeployerPassword+"\n")
+	} else {
+		_, stderr, err = conn.Run("sudo -n -l")
+	}
+	if err != nil {
+		return fmt.Errorf("deployer can't use sudo: %w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
 }
 
 func (m *layer1Manager) disableLoginUser(args Layer1Args) (bool, error) {
 	passwdCmd := fmt.Sprintf("passwd -d %s", args.LoginUser)
-	_, _, err := m.conn.RunSudoPassword(passwdCmd, args.LoginPassword)
+	_, _, err := m.conn.RunSudoPassword(passwdCmd, m.sudoPassword)
 	if err != nil {
 		return false, fmt.Errorf("error removing login user's password: %w", err)
 	}
 
 	usermodCmd := fmt.Sprintf("usermod -s /usr/sbin/nologin %s", args.LoginUser)
-	_, _, err = m.conn.RunSudoPassword(usermodCmd, args.LoginPassword)
+	_, _, err = m.conn.RunSudoPassword(usermodCmd, m.sudoPassword)
 	if err != nil {
 		return false, fmt.Errorf("error removing login user's shell: %w", err)
 	}
@@ -0,0 +1,110 @@
+package layer1
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+)
+
+// Actions applied to the login user once the deployer login is verified
+const (
+	// Remove the password and the shell
+	LoginUserDisable = "disable"
+	// Also lock and expire the account, remove its sudo access and kill its sessions
+	LoginUserLock = "lock"
+	// Remove the user and its home directory
+	LoginUserDelete = "delete"
+)
+
+func LoginUserActions() []string {
+	return []string{LoginUserDisable, LoginUserLock, LoginUserDelete}
+}
+
+// switchToDeployer replaces the connection of the login user with a new one
+// of the deployer, as the sessions of the login user are killed when it is
+// locked or deleted
+func (m *layer1Manager) switchToDeployer(args Layer1Args) error {
+	conn := ssh.SSHConnection{UseSSHKey: true, KeyPath: args.KeyPath}
+	address := fmt.Sprintf("%s:%d", args.Host, args.Port)
+	err := conn.Connect(args.DeployerUser, address)
+	if err != nil {
+		return fmt.Errorf("error connecting as %s: %w", args.DeployerUser, err)
+	}
+
+	m.conn = conn
+	m.deployerConn = &conn
+	m.sudoPassword = ""
+	if args.SudoRequirePassword {
+		m.sudoPassword = args.DeployerPassword
+	}
+	return nil
+}
+
+func (m *layer1Manager) sudo(cmd string) error {
+	_, stderr, err := m.conn.RunSudoPassword(cmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("%w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// removeLoginUserSudoers deletes the sudoers.d files with rules of the login
+// user (like 010_pi-nopasswd)
+func (m *layer1Manager) removeLoginUserSudoers(args Layer1Args) error {
+	removeCmd := fmt.Sprintf("grep -lE \"^%s[[:space:]]\" /etc/sudoers.d/* | xargs -r rm -f", args.LoginUser)
+	if err := m.sudo(removeCmd); err != nil {
+		return fmt.Errorf("error removing login user's sudoers: %w", err)
+	}
+	return nil
+}
+
+func (m *layer1Manager) lockLoginUser(args Layer1Args) (bool, error) {
+	usermodCmd := fmt.Sprintf("usermod -L -e 1 -s /usr/sbin/nologin %s", args.LoginUser)
+	if err := m.sudo(usermodCmd); err != nil {
+		return false, fmt.Errorf("error locking login user: %w", err)
+	}
+	// Right after the first change, so a failure in the next steps also
+	// unlocks the login user
+	m.pushUndo("login user", func() error { return m.unlockLoginUser(args) })
+
+	if err := m.removeLoginUserSudoers(args); err != nil {
+		return false, err
+	}
+
+	// pkill fails if there are no processes
+	m.sudo(fmt.Sprintf("pkill -KILL -u %s", args.LoginUser))
+	return true, nil
+}
+
+func (m *layer1Manager) deleteLoginUser(args Layer1Args) (bool, error) {
+	_, _, err := m.conn.Run(fmt.Sprintf("id %s", args.LoginUser))
+	if err != nil {
+		return false, nil
+	}
+
+	m.sudo(fmt.Sprintf("pkill -KILL -u %s", args.LoginUser))
+	if err := m.sudo(fmt.Sprintf("userdel -r %s", args.LoginUser)); err != nil {
+		return false, fmt.Errorf("error deleting login user: %w", err)
+	}
+
+	// Only after userdel succeeds, so a failure doesn't leave the login user
+	// without sudo
+	if err := m.removeLoginUserSudoers(args); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// unlockLoginUser reverts lockLoginUser (and disableLoginUser). Restoring the
+// password hash also removes the lock.
+func (m *layer1Manager) unlockLoginUser(args Layer1Args) error {
+	usermodCmd := fmt.Sprintf("usermod -e \"\" %s", args.LoginUser)
+	if err := m.sudo(usermodCmd); err != nil {
+		return fmt.Errorf("error unlocking login user: %w", err)
+	}
+	if err := m.restoreLoginUserSudoers(args); err != nil {
+		return err
+	}
+	return m.restoreLoginUser(args)
+}
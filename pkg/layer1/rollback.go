@@ -0,0 +1,190 @@
+package layer1
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/firewall"
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+	"github.com/sralloza/rpi-provisioner/pkg/sshd"
+	"github.com/sralloza/rpi-provisioner/pkg/sudoers"
+)
+
+// Directory of the server where the state is saved before layer1 changes it
+const backupDir = "/var/backups/rpi-provisioner/layer1"
+
+// undoAction reverts the changes of a layer1 step
+type undoAction struct {
+	name string
+	run  func() error
+}
+
+func (m *layer1Manager) pushUndo(name string, run func() error) {
+	m.undo = append(m.undo, undoAction{name: name, run: run})
+}
+
+// rollback runs the undo actions in reverse order. It doesn't stop on
+// errors, so as much state as possible is restored.
+func (m *layer1Manager) rollback() error {
+	errors := []string{}
+	for i := len(m.undo) - 1; i >= 0; i-- {
+		action := m.undo[i]
+		info.Title("Rolling back: %s", action.name)
+		if err := action.run(); err != nil {
+			info.Fail()
+			errors = append(errors, err.Error())
+			continue
+		}
+		info.Ok()
+	}
+	m.undo = nil
+
+	if len(errors) > 0 {
+		return fmt.Errorf("rollback failed: %s", strings.Join(errors, "; "))
+	}
+	return nil
+}
+
+// backupState saves the sudoers, the sshd config and the password and shell
+// of the login user and root. It is refreshed on every run, so a rollback
+// restores the state before the last execution. The backup is written to a
+// temporary directory that replaces the previous one at the end, so a failed
+// backup keeps the previous one.
+func (m *layer1Manager) backupState(args Layer1Args) error {
+	tmpDir := backupDir + ".tmp"
+	commands := []string{
+		fmt.Sprintf("rm -rf %s", tmpDir),
+		fmt.Sprintf("mkdir -p %s", tmpDir),
+		fmt.Sprintf("chmod 700 %s", tmpDir),
+		fmt.Sprintf("cp -p /etc/sudoers %s/sudoers", tmpDir),
+		fmt.Sprintf("cp -a /etc/sudoers.d %s/sudoers.d", tmpDir),
+		fmt.Sprintf("cp -p %s %s/sshd_config", sshd.ConfigPath, tmpDir),
+		fmt.Sprintf("getent shadow %s > %s/login-shadow", args.LoginUser, tmpDir),
+		fmt.Sprintf("getent passwd %s | cut -d: -f7 > %s/login-shell", args.LoginUser, tmpDir),
+		fmt.Sprintf("getent shadow root > %s/root-shadow", tmpDir),
+		fmt.Sprintf("rm -rf %s && mv %s %s", backupDir, tmpDir, backupDir),
+	}
+	for _, cmd := range commands {
+		_, stderr, err := m.conn.RunSudoPassword(cmd, m.sudoPassword)
+		if err != nil {
+			m.conn.RunSudoPassword(fmt.Sprintf("rm -rf %s", tmpDir), m.sudoPassword)
+			return fmt.Errorf("error backing up server state: %w [%s]", err, strings.TrimSpace(stderr))
+		}
+	}
+	return nil
+}
+
+// restoreSudoers restores /etc/sudoers and the drop-in of the deployer (it is
+// removed if it wasn't in the backup). The rest of /etc/sudoers.d is not
+// touched, as other commands (like users) also write there.
+func (m *layer1Manager) restoreSudoers(args Layer1Args) error {
+	backup := fmt.Sprintf("%s/sudoers", backupDir)
+	dropInPath := sudoers.DropInPath(args.DeployerUser)
+	dropInBackup := fmt.Sprintf("%s.d/%s", backup, path.Base(dropInPath))
+	restoreCmd := fmt.Sprintf("visudo -cf %s && cp -p %s /etc/sudoers"+
+		" && if [ -f %s ]; then cp -p %s %s; else rm -f %s; fi",
+		backup, backup, dropInBackup, dropInBackup, dropInPath, dropInPath)
+	_, stderr, err := m.conn.RunSudoPassword(restoreCmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("error restoring sudoers: %w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// restoreLoginUserSudoers copies back the files of /etc/sudoers.d with rules
+// of the login user, removed when it is locked
+func (m *layer1Manager) restoreLoginUserSudoers(args Layer1Args) error {
+	restoreCmd := restoreLoginUserSudoersCmd(args, backupDir+"/sudoers.d", "/etc/sudoers.d")
+	_, stderr, err := m.conn.RunSudoPassword(restoreCmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("error restoring login user's sudoers: %w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// restoreLoginUserSudoersCmd builds the command that copies the files of
+// backup with rules of the login user to dir. The drop-in of the deployer is
+// skipped, as the rollback runs as the deployer and restoreSudoers owns it.
+func restoreLoginUserSudoersCmd(args Layer1Args, backup, dir string) string {
+	deployerDropIn := path.Join(backup, path.Base(sudoers.DropInPath(args.DeployerUser)))
+	return fmt.Sprintf("if [ -d %s ]; then grep -lE \"^%s[[:space:]]\" %s/* | grep -vxF %s | xargs -r cp -p -t %s/; fi",
+		backup, args.LoginUser, backup, deployerDropIn, dir)
+}
+
+func (m *layer1Manager) restoresshdConfig() error {
+	restoreCmd := fmt.Sprintf("cp -p %s/sshd_config %s && rm -f %s && service ssh reload", backupDir, sshd.ConfigPath, sshd.DropInPath)
+	_, stderr, err := m.conn.RunSudoPassword(restoreCmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("error restoring sshd config: %w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// restorePassword sets the password hash (and lock state) saved in the backup
+func (m *layer1Manager) restorePassword(user, backupName string) error {
+	restoreCmd := fmt.Sprintf("usermod -p \"$(cut -d: -f2 %s/%s)\" %s", backupDir, backupName, user)
+	_, stderr, err := m.conn.RunSudoPassword(restoreCmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("error restoring %s password: %w [%s]", user, err, strings.TrimSpace(stderr))
+	}
+	delete(m.passwordsSet, user)
+	return nil
+}
+
+func (m *layer1Manager) restoreLoginUser(args Layer1Args) error {
+	err := m.restorePassword(args.LoginUser, "login-shadow")
+	if err != nil {
+		return err
+	}
+
+	restoreCmd := fmt.Sprintf("usermod -s \"$(cat %s/login-shell)\" %s", backupDir, args.LoginUser)
+	_, stderr, err := m.conn.RunSudoPassword(restoreCmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("error restoring login user's shell: %w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// Rollback restores the state saved in the server before layer1 was
+// executed. It connects as the deployer user with the ssh key, as the login
+// user is disabled by layer1.
+func (m *layer1Manager) Rollback(args Layer1Args) error {
+	address := fmt.Sprintf("%s:%d", args.Host, args.Port)
+	m.conn = ssh.SSHConnection{UseSSHKey: true, KeyPath: args.KeyPath}
+
+	info.Title("Connecting to %s", address)
+	err := m.conn.Connect(args.DeployerUser, address)
+	if err != nil {
+		info.Fail()
+		return fmt.Errorf("SSH connection error: %w", err)
+	}
+	info.Ok()
+	defer m.conn.Close()
+
+	info.Title("Checking sudo access")
+	if _, _, err := m.conn.Run("sudo -n true"); err == nil {
+		m.sudoPassword = ""
+		info.Ok()
+	} else if len(args.DeployerPassword) > 0 {
+		m.sudoPassword = args.DeployerPassword
+		info.Ok()
+	} else {
+		info.Fail()
+		return fmt.Errorf("%s needs a password to use sudo, pass --deployer-password", args.DeployerUser)
+	}
+
+	_, _, err = m.conn.RunSudoPassword(fmt.Sprintf("test -d %s", backupDir), m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("backup not found in %s, layer1 was not executed", backupDir)
+	}
+
+	// Same order as the provisioning, so the rollback runs them in reverse
+	m.pushUndo("sudoers", func() error { return m.restoreSudoers(args) })
+	m.pushUndo("root password", func() error { return m.restorePassword("root", "root-shadow") })
+	m.pushUndo("sshd config", m.restoresshdConfig)
+	m.pushUndo("firewall", firewall.NewManager(m.conn, m.sudoPassword).Revert)
+	m.pushUndo("login user", func() error { return m.unlockLoginUser(args) })
+	return m.rollback()
+}
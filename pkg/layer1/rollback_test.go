@@ -0,0 +1,59 @@
+package layer1
+
+import (
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/sralloza/rpi-provisioner/pkg/sudoers"
+)
+
+func TestRestoreLoginUserSudoersSkipsDeployerDropIn(t *testing.T) {
+	args := Layer1Args{LoginUser: "pi", DeployerUser: "deployer"}
+	dropIn := path.Base(sudoers.DropInPath(args.DeployerUser))
+	backup := t.TempDir()
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"010_pi-nopasswd": "pi ALL=(ALL) NOPASSWD: ALL\n",
+		"020_bob":         "bob ALL=(ALL) ALL\n",
+		// Matches the login user, but it belongs to the deployer
+		dropIn: "deployer ALL=(ALL) NOPASSWD: ALL\npi ALL=(ALL) ALL\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(backup, name), []byte(content), 0440); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := "deployer ALL=(ALL) ALL\n"
+	if err := os.WriteFile(filepath.Join(dir, dropIn), []byte(current), 0440); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := restoreLoginUserSudoersCmd(args, backup, dir)
+	if out, err := exec.Command("bash", "-c", cmd).CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v [%s]", cmd, err, out)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "010_pi-nopasswd"))
+	if err != nil || string(got) != files["010_pi-nopasswd"] {
+		t.Errorf("login user's sudoers not restored: %q, %v", got, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "020_bob")); !os.IsNotExist(err) {
+		t.Errorf("sudoers of other users restored: %v", err)
+	}
+	got, err = os.ReadFile(filepath.Join(dir, dropIn))
+	if err != nil || string(got) != current {
+		t.Errorf("deployer drop-in changed: %q, %v", got, err)
+	}
+}
+
+func TestRestoreLoginUserSudoersWithoutBackup(t *testing.T) {
+	args := Layer1Args{LoginUser: "pi", DeployerUser: "deployer"}
+	cmd := restoreLoginUserSudoersCmd(args, filepath.Join(t.TempDir(), "missing"), t.TempDir())
+	if out, err := exec.Command("bash", "-c", cmd).CombinedOutput(); err != nil {
+		t.Fatalf("%s: %v [%s]", cmd, err, out)
+	}
+}
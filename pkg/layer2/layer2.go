@@ -6,9 +6,11 @@ import (
 	"strings"
 
 	"github.com/rs/zerolog"
+	"github.com/sralloza/rpi-provisioner/pkg/fail2ban"
 	"github.com/sralloza/rpi-provisioner/pkg/info"
 	"github.com/sralloza/rpi-provisioner/pkg/logging"
 	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+	"github.com/sralloza/rpi-provisioner/pkg/updates"
 )
 
 type Layer2Args struct {
@@ -16,6 +18,9 @@ type Layer2Args struct {
 	Host             string
 	Port             int
 	TailscaleAuthKey string
+	// Extra IPs or networks never banned by fail2ban
+	Fail2banIgnoreIPs []string
+	Upgrades          updates.Config
 }
 
 func NewManager() *layer2Manager {
@@ -131,6 +136,50 @@ func (m *layer2Manager) provisionLayer2(args Layer2Args) (Layer2Result, error) {
 		info.Skipped()
 	}
 
+	fail2banManager := fail2ban.NewManager(m.conn, "")
+	info.Title("Installing fail2ban")
+	if installed, err := fail2banManager.Install(); err != nil {
+		info.Fail()
+		return result, err
+	} else if installed {
+		info.Ok()
+	} else {
+		info.Skipped()
+	}
+
+	info.Title("Configuring fail2ban")
+	jail := fail2ban.DefaultJail(args.Port)
+	jail.IgnoreIPs = args.Fail2banIgnoreIPs
+	if configured, err := fail2banManager.Configure(jail); err != nil {
+		info.Fail()
+		return result, err
+	} else if configured {
+		info.Ok()
+	} else {
+		info.Skipped()
+	}
+
+	updatesManager := updates.NewManager(m.conn, "")
+	info.Title("Installing unattended-upgrades")
+	if installed, err := updatesManager.Install(); err != nil {
+		info.Fail()
+		return result, err
+	} else if installed {
+		info.Ok()
+	} else {
+		info.Skipped()
+	}
+
+	info.Title("Configuring unattended-upgrades")
+	if configured, err := updatesManager.Configure(args.Upgrades); err != nil {
+		info.Fail()
+		return result, err
+	} else if configured {
+		info.Ok()
+	} else {
+		info.Skipped()
+	}
+
 	info.Title("Installing docker")
 	installed, dockerInstallErr, err := m.installDocker(args)
 	if err != nil {
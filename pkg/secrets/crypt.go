@@ -0,0 +1,165 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Alphabet of the salt and the hash of crypt(3)
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Alphabet of the generated passwords. It doesn't include quotes, spaces or
+// shell metacharacters, so passwords can be used in remote commands.
+const passwordAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789-_.,+=@"
+
+const (
+	saltLength   = 16
+	sha512Rounds = 5000
+)
+
+// GeneratePassword returns a random password of length characters
+func GeneratePassword(length int) (string, error) {
+	return randomString(passwordAlphabet, length)
+}
+
+// HashPassword returns the SHA-512 crypt(3) hash of password ($6$salt$hash),
+// as expected by chpasswd -e and usermod -p
+func HashPassword(password string) (string, error) {
+	salt, err := randomString(cryptAlphabet, saltLength)
+	if err != nil {
+		return "", err
+	}
+	return sha512Crypt(password, salt), nil
+}
+
+// CheckPassword returns true if hash is the SHA-512 crypt(3) hash of
+// password. Other hash types (like yescrypt) and custom rounds are not
+// supported, so they never match.
+func CheckPassword(password, hash string) bool {
+	// $6$salt$digest
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "" || parts[1] != "6" || strings.HasPrefix(parts[2], "rounds=") {
+		return false
+	}
+	return sha512Crypt(password, parts[2]) == hash
+}
+
+func randomString(alphabet string, length int) (string, error) {
+	result := make([]byte, length)
+	max := big.NewInt(int64(len(alphabet)))
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("error generating random string: %w", err)
+		}
+		result[i] = alphabet[n.Int64()]
+	}
+	return string(result), nil
+}
+
+// sha512Crypt implements the SHA-512 based crypt(3) with the default number
+// of rounds, see https://www.akkadia.org/drepper/SHA-crypt.txt
+func sha512Crypt(password, salt string) string {
+	pw := []byte(password)
+	s := []byte(salt)
+
+	b := sha512.New()
+	b.Write(pw)
+	b.Write(s)
+	b.Write(pw)
+	digestB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pw)
+	a.Write(s)
+	i := len(pw)
+	for ; i > sha512.Size; i -= sha512.Size {
+		a.Write(digestB)
+	}
+	a.Write(digestB[:i])
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(pw)
+		}
+	}
+	digestA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range pw {
+		dp.Write(pw)
+	}
+	p := repeatDigest(dp.Sum(nil), len(pw))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		ds.Write(s)
+	}
+	sBytes := repeatDigest(ds.Sum(nil), len(s))
+
+	c := digestA
+	for i := 0; i < sha512Rounds; i++ {
+		h := sha512.New()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sBytes)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+
+	return fmt.Sprintf("$6$%s$%s", salt, encodeSHA512Digest(c))
+}
+
+// repeatDigest repeats digest until length bytes are filled
+func repeatDigest(digest []byte, length int) []byte {
+	result := make([]byte, 0, length)
+	for len(result) < length {
+		n := length - len(result)
+		if n > len(digest) {
+			n = len(digest)
+		}
+		result = append(result, digest[:n]...)
+	}
+	return result
+}
+
+// encodeSHA512Digest encodes the digest with the byte order and base64
+// variant of crypt(3)
+func encodeSHA512Digest(c []byte) string {
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+		{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51},
+		{31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35},
+		{15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19},
+		{62, 20, 41},
+	}
+
+	result := []byte{}
+	encode := func(w uint, n int) {
+		for ; n > 0; n-- {
+			result = append(result, cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for _, o := range order {
+		encode(uint(c[o[0]])<<16|uint(c[o[1]])<<8|uint(c[o[2]]), 4)
+	}
+	encode(uint(c[63]), 2)
+	return string(result)
+}
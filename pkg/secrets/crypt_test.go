@@ -0,0 +1,37 @@
+package secrets
+
+import "testing"
+
+func TestSHA512Crypt(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		want     string
+	}{
+		// Reference vector of https://www.akkadia.org/drepper/SHA-crypt.txt
+		{"Hello world!", "saltstring", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		// Generated with openssl passwd -6
+		{"hunter2", "abcdefghSALT1234", "$6$abcdefghSALT1234$kI5Bn4hi2QSj4dyu0Ba7N0Ie2bIFM920NoZPBOFuuoiDte0X8IYApun.J91qSIAfCQcJWJXgPTpMiREhLNJol."},
+	}
+	for _, test := range tests {
+		if got := sha512Crypt(test.password, test.salt); got != test.want {
+			t.Errorf("sha512Crypt(%q, %q) = %q, want %q", test.password, test.salt, got, test.want)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+	hash, err := HashPassword("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckPassword("hunter2", hash) {
+		t.Errorf("CheckPassword doesn't accept the password of %q", hash)
+	}
+	if CheckPassword("hunter3", hash) {
+		t.Errorf("CheckPassword accepts a wrong password for %q", hash)
+	}
+	if CheckPassword("hunter2", "$y$j9T$salt$hash") {
+		t.Errorf("CheckPassword accepts a yescrypt hash")
+	}
+}
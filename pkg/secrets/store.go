@@ -0,0 +1,226 @@
+package secrets
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/sralloza/rpi-provisioner/pkg/state"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const storeFile = "secrets.enc"
+
+// Environment variable with the passphrase of the store, if it is not set
+// the passphrase is asked interactively
+const PassphraseEnv = "RPI_PROVISIONER_PASSPHRASE"
+
+// scrypt parameters recommended for interactive logins
+const (
+	scryptN   = 1 << 15
+	scryptR   = 8
+	scryptP   = 1
+	saltBytes = 16
+)
+
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted secrets file")
+
+// Secret is a password generated for a user of a host
+type Secret struct {
+	User      string    `json:"user"`
+	Password  string    `json:"password"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Store holds the secrets of each host, it is saved encrypted with a key
+// derived from the passphrase
+type Store struct {
+	Hosts      map[string][]Secret `json:"hosts"`
+	path       string
+	passphrase string
+}
+
+// encryptedFile is the format of the file on disk
+type encryptedFile struct {
+	Version int    `json:"version"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Data    []byte `json:"data"`
+}
+
+// Path returns the path of the store
+func Path() (string, error) {
+	dir, err := state.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, storeFile), nil
+}
+
+// Exists returns true if the store has been created
+func Exists() (bool, error) {
+	path, err := Path()
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Load decrypts the store, a missing file returns an empty store
+func Load(passphrase string) (*Store, error) {
+	path, err := Path()
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{Hosts: map[string][]Secret{}, path: path, passphrase: passphrase}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading secrets: %w", err)
+	}
+
+	file := encryptedFile{}
+	err = json.Unmarshal(content, &file)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding secrets: %w", err)
+	}
+
+	aead, err := newAEAD(passphrase, file.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, file.Nonce, file.Data, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	err = json.Unmarshal(plaintext, store)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding secrets: %w", err)
+	}
+	if store.Hosts == nil {
+		store.Hosts = map[string][]Secret{}
+	}
+	return store, nil
+}
+
+// Save encrypts the store with a new salt and nonce
+func (s *Store) Save() error {
+	plaintext, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("error encoding secrets: %w", err)
+	}
+
+	salt := make([]byte, saltBytes)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("error generating salt: %w", err)
+	}
+	aead, err := newAEAD(s.passphrase, salt)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("error generating nonce: %w", err)
+	}
+
+	file := encryptedFile{
+		Version: 1,
+		Salt:    salt,
+		Nonce:   nonce,
+		Data:    aead.Seal(nil, nonce, plaintext, nil),
+	}
+	content, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding secrets: %w", err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return fmt.Errorf("error creating secrets directory: %w", err)
+	}
+	// Write to a temporary file, so the store is not corrupted if it fails
+	tmpPath := s.path + ".tmp"
+	err = os.WriteFile(tmpPath, append(content, '\n'), 0600)
+	if err != nil {
+		return fmt.Errorf("error saving secrets: %w", err)
+	}
+	err = os.Rename(tmpPath, s.path)
+	if err != nil {
+		return fmt.Errorf("error saving secrets: %w", err)
+	}
+	return nil
+}
+
+// Set saves the password of user in host, replacing the previous one
+func (s *Store) Set(host, user, password string) {
+	secret := Secret{User: user, Password: password, UpdatedAt: time.Now()}
+	for i, existing := range s.Hosts[host] {
+		if existing.User == user {
+			s.Hosts[host][i] = secret
+			return
+		}
+	}
+	s.Hosts[host] = append(s.Hosts[host], secret)
+}
+
+// Password returns the saved password of user in host
+func (s *Store) Password(host, user string) (string, bool) {
+	for _, secret := range s.Hosts[host] {
+		if secret.User == user {
+			return secret.Password, true
+		}
+	}
+	return "", false
+}
+
+// Get returns the secrets of host
+func (s *Store) Get(host string) ([]Secret, bool) {
+	secrets, ok := s.Hosts[host]
+	return secrets, ok
+}
+
+// Delete removes the secrets of host
+func (s *Store) Delete(host string) bool {
+	_, ok := s.Hosts[host]
+	delete(s.Hosts, host)
+	return ok
+}
+
+// HostNames returns the hosts of the store sorted by name
+func (s *Store) HostNames() []string {
+	hosts := []string{}
+	for host := range s.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// newAEAD derives the key with scrypt and returns a XChaCha20-Poly1305 cipher
+func newAEAD(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, scryptN, scryptR, scryptP, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key: %w", err)
+	}
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("error creating cipher: %w", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,218 @@
+package ssh
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const knownHostsPath = "~/.ssh/known_hosts"
+
+// StrictHostKeys enables the verification of the host keys with the
+// known_hosts file. It is disabled by default, so a re-flashed raspberry can
+// be provisioned again without editing known_hosts.
+var StrictHostKeys = false
+
+// hostKeyCallback verifies the host key with the known_hosts file. Unknown
+// hosts are accepted, but a host whose key changed is rejected.
+func hostKeyCallback() (ssh.HostKeyCallback, error) {
+	path := expandPath(knownHostsPath)
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil
+		}
+		if errors.As(err, &keyErr) {
+			return fmt.Errorf("host key of %s doesn't match the one in %s (line %d), remove it if the server was reinstalled: %w",
+				hostname, keyErr.Want[0].Filename, keyErr.Want[0].Line, err)
+		}
+		return err
+	}, nil
+}
+
+// AddKnownHosts saves the keys of hosts in the known_hosts file, replacing
+// the keys previously saved for them (including hashed entries)
+func AddKnownHosts(hosts []string, keys []ssh.PublicKey) error {
+	path := expandPath(knownHostsPath)
+
+	normalized := map[string]bool{}
+	addresses := []string{}
+	for _, host := range hosts {
+		address := knownhosts.Normalize(host)
+		if !normalized[address] {
+			normalized[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+
+	lines, err := readKnownHosts(path)
+	if err != nil {
+		return err
+	}
+
+	result := []string{}
+	for _, line := range lines {
+		if !knownHostsLineMatches(line, normalized) {
+			result = append(result, line)
+		}
+	}
+	for _, key := range keys {
+		result = append(result, knownhosts.Line(addresses, key))
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", filepath.Dir(path), err)
+	}
+	err = os.WriteFile(path, []byte(strings.Join(result, "\n")+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("error writing %s: %w", path, err)
+	}
+	return nil
+}
+
+// CopyKnownHostsPort saves keys for newPort of the hosts that are known with
+// oldPort and have one of keys, and of the extra hosts. It returns the
+// addresses updated.
+func CopyKnownHostsPort(oldPort, newPort int, keys []ssh.PublicKey, extraHosts []string) ([]string, error) {
+	lines, err := readKnownHosts(expandPath(knownHostsPath))
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := map[string]bool{}
+	for _, key := range keys {
+		wanted[string(key.Marshal())] = true
+	}
+
+	hosts := []string{}
+	for _, line := range lines {
+		_, lineHosts, key, _, _, err := ssh.ParseKnownHosts([]byte(line))
+		if err != nil || !wanted[string(key.Marshal())] {
+			continue
+		}
+		for _, address := range lineHosts {
+			// Hashed hosts and patterns can't be copied
+			if strings.HasPrefix(address, "|") || strings.ContainsAny(address, "*?!") {
+				continue
+			}
+			host, port := splitKnownHost(address)
+			if port == oldPort {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	hosts = append(hosts, extraHosts...)
+
+	addresses := []string{}
+	for _, host := range hosts {
+		address := knownhosts.Normalize(net.JoinHostPort(host, strconv.Itoa(newPort)))
+		if !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	if err := AddKnownHosts(addresses, keys); err != nil {
+		return nil, err
+	}
+	return addresses, nil
+}
+
+// splitKnownHost splits addresses like host or [host]:port (port 22 if it
+// is not present)
+func splitKnownHost(address string) (string, int) {
+	if !strings.HasPrefix(address, "[") {
+		return address, 22
+	}
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, 0
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return host, 0
+	}
+	return host, port
+}
+
+func readKnownHosts(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+	defer file.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Buffer(nil, 1024*1024); scanner.Scan(); {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
+
+// knownHostsLineMatches returns true if the line contains any of the
+// (normalized) addresses, either in plain text or hashed
+func knownHostsLineMatches(line string, addresses map[string]bool) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "@") {
+		return false
+	}
+	for _, host := range strings.Split(fields[0], ",") {
+		if strings.HasPrefix(host, "|1|") {
+			if hashedHostMatches(host, addresses) {
+				return true
+			}
+			continue
+		}
+		if addresses[knownhosts.Normalize(host)] {
+			return true
+		}
+	}
+	return false
+}
+
+// hashedHostMatches checks a hashed host (|1|salt|hash, with HashKnownHosts
+// enabled in ssh_config) against the addresses
+func hashedHostMatches(host string, addresses map[string]bool) bool {
+	parts := strings.Split(host, "|")
+	if len(parts) != 4 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	for address := range addresses {
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(address))
+		if base64.StdEncoding.EncodeToString(mac.Sum(nil)) == parts[3] {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/pkg/sftp"
@@ -13,13 +14,22 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+const defaultKeyPath = "~/.ssh/id_rsa"
+
+// Time to wait for the connection opened by CheckLogin
+const checkLoginTimeout = 10 * time.Second
+
 type SSHConnection struct {
 	config    *ssh.ClientConfig
 	conn      *ssh.Client
 	Password  string
 	UseSSHKey bool
-	Timeout   int64
-	log       *zerolog.Logger
+	// Private key used with UseSSHKey, defaults to ~/.ssh/id_rsa
+	KeyPath string
+	Timeout int64
+	log     *zerolog.Logger
+	// Time to wait for the TCP connection, only set by CheckLogin
+	dialTimeout time.Duration
 }
 
 func (c *SSHConnection) Connect(user string, address string) error {
@@ -27,15 +37,33 @@ func (c *SSHConnection) Connect(user string, address string) error {
 	var auth []ssh.AuthMethod
 
 	if c.UseSSHKey {
-		auth = append(auth, publicKey("~/.ssh/id_rsa"))
+		keyPath := c.KeyPath
+		if keyPath == "" {
+			keyPath = defaultKeyPath
+		}
+		method, err := publicKey(keyPath)
+		if err != nil {
+			return err
+		}
+		auth = append(auth, method)
 	} else {
 		auth = append(auth, ssh.Password(c.Password))
 	}
 
+	callback := ssh.InsecureIgnoreHostKey()
+	if StrictHostKeys {
+		var err error
+		callback, err = hostKeyCallback()
+		if err != nil {
+			return err
+		}
+	}
+
 	c.config = &ssh.ClientConfig{
 		User:            user,
 		Auth:            auth,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: callback,
+		Timeout:         c.dialTimeout,
 	}
 	conn, err := ssh.Dial("tcp", address, c.config)
 	if err != nil {
@@ -45,12 +73,39 @@ func (c *SSHConnection) Connect(user string, address string) error {
 	return nil
 }
 
+// CheckLogin opens a new connection with the same credentials and runs a
+// command, to verify that the server still accepts new logins
+func (c SSHConnection) CheckLogin(user string, address string) error {
+	check := SSHConnection{
+		Password:    c.Password,
+		UseSSHKey:   c.UseSSHKey,
+		KeyPath:     c.KeyPath,
+		dialTimeout: checkLoginTimeout,
+	}
+	err := check.Connect(user, address)
+	if err != nil {
+		return err
+	}
+	defer check.Close()
+
+	_, _, err = check.Run("true")
+	if err != nil {
+		return fmt.Errorf("error running command in new connection: %w", err)
+	}
+	return nil
+}
+
 func (c SSHConnection) RunSudo(cmd string) (string, string, error) {
 	return c.Run(c.basicSudoStdin(cmd, ""))
 }
 
+// RunSudoPassword runs the command with sudo. The password is written to the
+// stdin of sudo, so it doesn't appear in the process list of the server.
 func (c SSHConnection) RunSudoPassword(cmd string, password string) (string, string, error) {
-	return c.Run(c.basicSudoStdin(cmd, password))
+	if len(password) == 0 {
+		return c.Run(c.basicSudoStdin(cmd, ""))
+	}
+	return c.run(c.basicSudoStdin(cmd, password), password+"\n")
 }
 
 func (c SSHConnection) Close() {
@@ -85,16 +140,29 @@ func (c SSHConnection) basicSudoStdin(cmd string, password string) string {
 	if len(password) == 0 {
 		return fmt.Sprintf("sudo bash -c '%s'", cmd)
 	}
-	return fmt.Sprintf("echo %s | sudo -S bash -c '%s'", password, cmd)
+	return fmt.Sprintf("sudo -S bash -c '%s'", cmd)
 }
 
 func (c SSHConnection) Run(cmd string) (string, string, error) {
+	return c.run(cmd, "")
+}
+
+// RunStdin runs the command writing stdin to its standard input, used to pass
+// passwords without showing them in the process list of the server
+func (c SSHConnection) RunStdin(cmd string, stdin string) (string, string, error) {
+	return c.run(cmd, stdin)
+}
+
+func (c SSHConnection) run(cmd string, stdin string) (string, string, error) {
 	c.log.Debug().Str("cmd", cmd).Msg("Running command via ssh")
 	sess, err := c.conn.NewSession()
 	if err != nil {
 		return "", "", fmt.Errorf("could not stablish ssh session: %w", err)
 	}
 	defer sess.Close()
+	if len(stdin) > 0 {
+		sess.Stdin = strings.NewReader(stdin)
+	}
 	sessStdOut, err := sess.StdoutPipe()
 	if err != nil {
 		return "", "", fmt.Errorf("could not get stdout pipe: %w", err)
@@ -132,14 +200,14 @@ func expandPath(path string) string {
 	return res
 }
 
-func publicKey(path string) ssh.AuthMethod {
+func publicKey(path string) (ssh.AuthMethod, error) {
 	key, err := os.ReadFile(expandPath(path))
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error reading ssh key: %w", err)
 	}
 	signer, err := ssh.ParsePrivateKey(key)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("error parsing ssh key %s: %w", path, err)
 	}
-	return ssh.PublicKeys(signer)
+	return ssh.PublicKeys(signer), nil
 }
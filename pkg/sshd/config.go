@@ -0,0 +1,166 @@
+package sshd
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Config is a parsed sshd_config. The lines are preserved, so the file can be
+// written back with only the needed changes.
+type Config struct {
+	lines []string
+}
+
+// Directive is a keyword of sshd_config with its arguments. Keywords are
+// case insensitive, so the parsed ones are stored in lower case.
+type Directive struct {
+	Keyword string
+	Args    []string
+	// Index of the line in the file
+	line int
+	// The directive belongs to a Match block
+	match bool
+}
+
+func (d Directive) Value() string {
+	return strings.Join(d.Args, " ")
+}
+
+func ParseConfig(content string) *Config {
+	content = strings.TrimSuffix(content, "\n")
+	if content == "" {
+		return &Config{}
+	}
+	return &Config{lines: strings.Split(content, "\n")}
+}
+
+func (c *Config) String() string {
+	return strings.Join(c.lines, "\n") + "\n"
+}
+
+// Directives returns the directives in order, ignoring comments
+func (c *Config) Directives() []Directive {
+	directives := []Directive{}
+	inMatch := false
+	for i, line := range c.lines {
+		directive, ok := parseLine(line)
+		if !ok {
+			continue
+		}
+		if directive.Keyword == "match" {
+			inMatch = true
+		}
+		directive.line = i
+		directive.match = inMatch
+		directives = append(directives, directive)
+	}
+	return directives
+}
+
+// Get returns the first occurrence of keyword outside Match blocks, which is
+// the one used by sshd
+func (c *Config) Get(keyword string) (Directive, bool) {
+	keyword = strings.ToLower(keyword)
+	for _, directive := range c.Directives() {
+		if directive.Keyword == keyword && !directive.match {
+			return directive, true
+		}
+	}
+	return Directive{}, false
+}
+
+// HasInclude returns true if the config includes the files matching pattern
+func (c *Config) HasInclude(pattern string) bool {
+	_, ok := c.includeLine(pattern)
+	return ok
+}
+
+func (c *Config) includeLine(pattern string) (int, bool) {
+	for _, directive := range c.Directives() {
+		if directive.Keyword != "include" || directive.match {
+			continue
+		}
+		for _, arg := range directive.Args {
+			if arg == pattern {
+				return directive.line, true
+			}
+			if matched, _ := filepath.Match(arg, pattern); matched {
+				return directive.line, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// EnsureInclude adds the Include of pattern at the top of the file, so the
+// included settings take precedence. Returns true if the config changed.
+func (c *Config) EnsureInclude(pattern string) bool {
+	if c.HasInclude(pattern) {
+		return false
+	}
+	c.lines = append([]string{"Include " + pattern}, c.lines...)
+	return true
+}
+
+// DisableBeforeInclude comments out the keywords that appear before the
+// Include of pattern, as they would override the included files.
+// Returns true if the config changed.
+func (c *Config) DisableBeforeInclude(pattern string, keywords []string) bool {
+	includeLine, ok := c.includeLine(pattern)
+	if !ok {
+		return false
+	}
+
+	disabled := map[string]bool{}
+	for _, keyword := range keywords {
+		disabled[strings.ToLower(keyword)] = true
+	}
+
+	changed := false
+	for _, directive := range c.Directives() {
+		if directive.line >= includeLine {
+			break
+		}
+		if disabled[directive.Keyword] {
+			c.lines[directive.line] = "# " + c.lines[directive.line] + " # disabled by rpi-provisioner"
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Disable comments out every occurrence of the keywords outside Match blocks.
+// Returns true if the config changed.
+func (c *Config) Disable(keywords []string) bool {
+	disabled := map[string]bool{}
+	for _, keyword := range keywords {
+		disabled[strings.ToLower(keyword)] = true
+	}
+
+	changed := false
+	for _, directive := range c.Directives() {
+		if disabled[directive.Keyword] && !directive.match {
+			c.lines[directive.line] = "# " + c.lines[directive.line] + " # disabled by rpi-provisioner"
+			changed = true
+		}
+	}
+	return changed
+}
+
+// parseLine parses "Keyword args", "Keyword=args" and "Keyword = args"
+func parseLine(line string) (Directive, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return Directive{}, false
+	}
+
+	end := strings.IndexAny(line, " \t=")
+	if end == -1 {
+		return Directive{Keyword: strings.ToLower(line)}, true
+	}
+	keyword := line[:end]
+	rest := strings.TrimLeft(line[end:], " \t")
+	rest = strings.TrimPrefix(rest, "=")
+
+	return Directive{Keyword: strings.ToLower(keyword), Args: strings.Fields(rest)}, true
+}
@@ -0,0 +1,182 @@
+package sshd
+
+import (
+	"slices"
+	"testing"
+)
+
+const testInclude = "/etc/ssh/sshd_config.d/*.conf"
+
+func TestParseConfig(t *testing.T) {
+	config := ParseConfig(`# comment
+Port 22
+PasswordAuthentication=no
+  PermitRootLogin = prohibit-password
+KbdInteractiveAuthentication	no
+
+Match User pi
+	PasswordAuthentication yes
+	Port 2222
+`)
+
+	tests := []struct {
+		keyword  string
+		expected string
+		found    bool
+	}{
+		{"Port", "22", true},
+		{"passwordauthentication", "no", true},
+		{"PermitRootLogin", "prohibit-password", true},
+		{"KbdInteractiveAuthentication", "no", true},
+		{"Ciphers", "", false},
+	}
+	for _, test := range tests {
+		directive, found := config.Get(test.keyword)
+		if found != test.found || directive.Value() != test.expected {
+			t.Errorf("%s: expected %q (%v), got %q (%v)", test.keyword, test.expected, test.found, directive.Value(), found)
+		}
+	}
+
+	matched := []string{}
+	for _, directive := range config.Directives() {
+		if directive.match {
+			matched = append(matched, directive.Keyword)
+		}
+	}
+	if !slices.Equal(matched, []string{"match", "passwordauthentication", "port"}) {
+		t.Errorf("unexpected directives in the Match block: %v", matched)
+	}
+}
+
+func TestEnsureInclude(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+		changed  bool
+	}{
+		{
+			name:     "missing include",
+			config:   "Port 22\n",
+			expected: "Include " + testInclude + "\nPort 22\n",
+			changed:  true,
+		},
+		{
+			name:     "existing include",
+			config:   "Include " + testInclude + "\nPort 22\n",
+			expected: "Include " + testInclude + "\nPort 22\n",
+		},
+		{
+			name:     "existing include with another case and separator",
+			config:   "Port 22\ninclude=" + testInclude + "\n",
+			expected: "Port 22\ninclude=" + testInclude + "\n",
+		},
+		{
+			name:     "include with a wider pattern",
+			config:   "Include /etc/ssh/sshd_config.d/*\n",
+			expected: "Include /etc/ssh/sshd_config.d/*\n",
+		},
+		{
+			name:     "include inside a Match block",
+			config:   "Match User pi\n\tInclude " + testInclude + "\n",
+			expected: "Include " + testInclude + "\nMatch User pi\n\tInclude " + testInclude + "\n",
+			changed:  true,
+		},
+		{
+			name:     "empty config",
+			config:   "",
+			expected: "Include " + testInclude + "\n",
+			changed:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := ParseConfig(test.config)
+			changed := config.EnsureInclude(testInclude)
+			if changed != test.changed || config.String() != test.expected {
+				t.Errorf("expected %q (%v), got %q (%v)", test.expected, test.changed, config.String(), changed)
+			}
+		})
+	}
+}
+
+func TestDisableBeforeInclude(t *testing.T) {
+	keywords := []string{"PasswordAuthentication", "Port"}
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+		changed  bool
+	}{
+		{
+			name:     "keywords before the include",
+			config:   "PasswordAuthentication=yes\nInclude " + testInclude + "\nPort 22\n",
+			expected: "# PasswordAuthentication=yes # disabled by rpi-provisioner\nInclude " + testInclude + "\nPort 22\n",
+			changed:  true,
+		},
+		{
+			name:     "keywords after the include",
+			config:   "Include " + testInclude + "\npasswordauthentication yes\n",
+			expected: "Include " + testInclude + "\npasswordauthentication yes\n",
+		},
+		{
+			name:     "without include",
+			config:   "PasswordAuthentication yes\n",
+			expected: "PasswordAuthentication yes\n",
+		},
+		{
+			name:     "comments and other keywords",
+			config:   "#Port 22\nX11Forwarding yes\nInclude " + testInclude + "\n",
+			expected: "#Port 22\nX11Forwarding yes\nInclude " + testInclude + "\n",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := ParseConfig(test.config)
+			changed := config.DisableBeforeInclude(testInclude, keywords)
+			if changed != test.changed || config.String() != test.expected {
+				t.Errorf("expected %q (%v), got %q (%v)", test.expected, test.changed, config.String(), changed)
+			}
+		})
+	}
+}
+
+func TestDisable(t *testing.T) {
+	config := ParseConfig("Port 22\nInclude " + testInclude + "\nListenAddress=0.0.0.0:2222\nMatch User pi\n\tPort 2200\n")
+	if !config.Disable([]string{"Port", "ListenAddress"}) {
+		t.Fatal("config not changed")
+	}
+
+	expected := "# Port 22 # disabled by rpi-provisioner\nInclude " + testInclude +
+		"\n# ListenAddress=0.0.0.0:2222 # disabled by rpi-provisioner\nMatch User pi\n\tPort 2200\n"
+	if config.String() != expected {
+		t.Errorf("expected %q, got %q", expected, config.String())
+	}
+	if config.Disable([]string{"Port", "ListenAddress"}) {
+		t.Error("config changed twice")
+	}
+}
+
+func TestAllowsUser(t *testing.T) {
+	tests := []struct {
+		allowUsers []string
+		user       string
+		expected   bool
+	}{
+		{nil, "deployer", true},
+		{[]string{"deployer"}, "deployer", true},
+		{[]string{"pi", "admin"}, "deployer", false},
+		{[]string{"deployer@192.168.1.*"}, "deployer", true},
+		{[]string{"deploy*"}, "deployer", true},
+		{[]string{"deploye?"}, "deployer", true},
+		{[]string{"deploy?"}, "deployer", false},
+	}
+	for _, test := range tests {
+		profile := Profile{AllowUsers: test.allowUsers}
+		if got := profile.AllowsUser(test.user); got != test.expected {
+			t.Errorf("%v allows %s: expected %v, got %v", test.allowUsers, test.user, test.expected, got)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package sshd
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+)
+
+const (
+	ConfigPath = "/etc/ssh/sshd_config"
+	// Managed drop-in. The files of sshd_config.d are read in order and the
+	// first value of each setting wins, so it must sort before the others
+	// (like 50-cloud-init.conf).
+	DropInPath = "/etc/ssh/sshd_config.d/10-rpi-provisioner.conf"
+	// Managed drop-in with the ports, written by the ssh-port command
+	PortDropInPath = "/etc/ssh/sshd_config.d/10-rpi-provisioner-port.conf"
+	dropInGlob     = "/etc/ssh/sshd_config.d/*.conf"
+)
+
+// Profile is the hardening applied to sshd. Empty values are not managed.
+type Profile struct {
+	PermitRootLogin              string
+	PasswordAuthentication       string
+	KbdInteractiveAuthentication string
+	UsePAM                       string
+	AllowUsers                   []string
+	Ciphers                      []string
+}
+
+var profiles = map[string]Profile{
+	// Only key authentication, same settings used before the drop-in
+	"basic": {
+		PermitRootLogin:              "no",
+		PasswordAuthentication:       "no",
+		KbdInteractiveAuthentication: "no",
+		UsePAM:                       "no",
+	},
+	// Also restrict the users that can login and use only AEAD/CTR ciphers
+	"strict": {
+		PermitRootLogin:              "no",
+		PasswordAuthentication:       "no",
+		KbdInteractiveAuthentication: "no",
+		UsePAM:                       "no",
+		Ciphers: []string{
+			"chacha20-poly1305@openssh.com",
+			"aes256-gcm@openssh.com",
+			"aes128-gcm@openssh.com",
+			"aes256-ctr",
+			"aes192-ctr",
+			"aes128-ctr",
+		},
+	},
+}
+
+func Profiles() []string {
+	names := []string{}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func GetProfile(name string) (Profile, error) {
+	profile, ok := profiles[name]
+	if !ok {
+		return Profile{}, fmt.Errorf("unknown sshd profile '%s' (valid profiles: %s)", name, strings.Join(Profiles(), ", "))
+	}
+	return profile, nil
+}
+
+// Directives returns the settings of the profile in sshd_config order
+func (p Profile) Directives() []Directive {
+	directives := []Directive{}
+	add := func(keyword string, args ...string) {
+		if len(args) > 0 && args[0] != "" {
+			directives = append(directives, Directive{Keyword: keyword, Args: args})
+		}
+	}
+	add("PermitRootLogin", p.PermitRootLogin)
+	add("PasswordAuthentication", p.PasswordAuthentication)
+	add("KbdInteractiveAuthentication", p.KbdInteractiveAuthentication)
+	add("UsePAM", p.UsePAM)
+	add("AllowUsers", p.AllowUsers...)
+	if len(p.Ciphers) > 0 {
+		add("Ciphers", strings.Join(p.Ciphers, ","))
+	}
+	return directives
+}
+
+// AllowsUser returns true if the AllowUsers patterns (USER or USER@HOST, with
+// * and ? wildcards) let user login. No patterns allow every user.
+func (p Profile) AllowsUser(user string) bool {
+	if len(p.AllowUsers) == 0 {
+		return true
+	}
+	for _, pattern := range p.AllowUsers {
+		userPattern, _, _ := strings.Cut(pattern, "@")
+		if matched, _ := path.Match(userPattern, user); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Render returns the content of the managed drop-in
+func (p Profile) Render() string {
+	lines := []string{"# Managed by rpi-provisioner, changes will be overwritten"}
+	for _, directive := range p.Directives() {
+		lines = append(lines, directive.Keyword+" "+directive.Value())
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func NewManager(conn ssh.SSHConnection, sudoPassword string) *sshdManager {
+	return &sshdManager{conn: conn, sudoPassword: sudoPassword}
+}
+
+type sshdManager struct {
+	conn         ssh.SSHConnection
+	sudoPassword string
+}
+
+// Apply writes the managed drop-in and makes sure sshd_config includes it
+// before any other setting. The result is validated with sshd -t and the
+// previous files are restored if it is invalid. sshd is not reloaded.
+func (m *sshdManager) Apply(profile Profile) (bool, error) {
+	keywords := []string{}
+	for _, directive := range profile.Directives() {
+		keywords = append(keywords, directive.Keyword)
+	}
+	return m.applyDropIn(DropInPath, profile.Render(), keywords, false)
+}
+
+// SetPorts writes the ports sshd listens on in their own drop-in. sshd
+// listens on every Port (and ListenAddress), so all of them are disabled in
+// sshd_config and the other drop-ins, not only the ones that take
+// precedence. sshd is not reloaded.
+func (m *sshdManager) SetPorts(ports []int) (bool, error) {
+	lines := []string{"# Managed by rpi-provisioner, changes will be overwritten"}
+	for _, port := range ports {
+		lines = append(lines, fmt.Sprintf("Port %d", port))
+	}
+	return m.applyDropIn(PortDropInPath, strings.Join(lines, "\n")+"\n", []string{"Port", "ListenAddress"}, true)
+}
+
+// Ports returns the ports sshd listens on, including the ones of ListenAddress
+func (m *sshdManager) Ports() ([]int, error) {
+	directives, err := m.Effective([]string{"Port", "ListenAddress"})
+	if err != nil {
+		return nil, err
+	}
+	ports := []int{}
+	for _, directive := range directives {
+		value := directive.Value()
+		if directive.Keyword == "listenaddress" {
+			// sshd -T always prints the port: 0.0.0.0:22 or [::]:22
+			_, portStr, err := net.SplitHostPort(strings.Fields(value)[0])
+			if err != nil {
+				continue
+			}
+			value = portStr
+		}
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sshd port '%s'", value)
+		}
+		if !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// applyDropIn writes a drop-in and disables the keywords it manages in
+// sshd_config (before the Include, or everywhere including the other
+// drop-ins), restoring the previous files if the result is invalid
+func (m *sshdManager) applyDropIn(path, dropIn string, keywords []string, everywhere bool) (bool, error) {
+	mainContent, _, err := m.conn.RunSudoPassword("cat "+ConfigPath, m.sudoPassword)
+	if err != nil {
+		return false, fmt.Errorf("error getting current sshd config: %w", err)
+	}
+	previousDropIn, _, err := m.conn.RunSudoPassword("cat "+path, m.sudoPassword)
+	if err != nil {
+		previousDropIn = ""
+	}
+
+	config := ParseConfig(mainContent)
+	mainChanged := config.EnsureInclude(dropInGlob)
+	if everywhere {
+		mainChanged = config.Disable(keywords) || mainChanged
+	} else {
+		mainChanged = config.DisableBeforeInclude(dropInGlob, keywords) || mainChanged
+	}
+
+	// Previous and new content of the other drop-ins that change
+	previousOthers := map[string]string{}
+	others := map[string]string{}
+	if everywhere {
+		previousOthers, others, err = m.disableInDropIns(path, keywords)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if !mainChanged && dropIn == previousDropIn && len(others) == 0 {
+		return false, nil
+	}
+
+	err = m.upload(path, dropIn)
+	if err != nil {
+		return false, err
+	}
+	if mainChanged {
+		err = m.upload(ConfigPath, config.String())
+		if err != nil {
+			m.restore(mainContent, path, previousDropIn, previousOthers)
+			return false, err
+		}
+	}
+	for otherPath, content := range others {
+		err = m.upload(otherPath, content)
+		if err != nil {
+			m.restore(mainContent, path, previousDropIn, previousOthers)
+			return false, err
+		}
+	}
+
+	err = m.Validate()
+	if err != nil {
+		m.restore(mainContent, path, previousDropIn, previousOthers)
+		return false, err
+	}
+	return true, nil
+}
+
+// disableInDropIns disables the keywords in the drop-ins of sshd_config.d
+// except path. Returns the previous and new content of the changed files.
+func (m *sshdManager) disableInDropIns(path string, keywords []string) (map[string]string, map[string]string, error) {
+	previous := map[string]string{}
+	changed := map[string]string{}
+
+	// ls fails if there are no drop-ins
+	stdout, _, err := m.conn.RunSudoPassword("ls "+dropInGlob, m.sudoPassword)
+	if err != nil {
+		return previous, changed, nil
+	}
+	for _, dropInPath := range strings.Fields(stdout) {
+		if dropInPath == path {
+			continue
+		}
+		content, _, err := m.conn.RunSudoPassword("cat "+dropInPath, m.sudoPassword)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading %s: %w", dropInPath, err)
+		}
+		config := ParseConfig(content)
+		if config.Disable(keywords) {
+			previous[dropInPath] = content
+			changed[dropInPath] = config.String()
+		}
+	}
+	return previous, changed, nil
+}
+
+// Validate checks the configuration with sshd -t
+func (m *sshdManager) Validate() error {
+	_, stderr, err := m.conn.RunSudoPassword("sshd -t", m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("invalid sshd config: %w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+func (m *sshdManager) Reload() error {
+	_, _, err := m.conn.RunSudoPassword("service ssh reload", m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("error reloading ssh service: %w", err)
+	}
+	return nil
+}
+
+// Effective returns the value of the keywords used by sshd (sshd -T)
+func (m *sshdManager) Effective(keywords []string) ([]Directive, error) {
+	stdout, stderr, err := m.conn.RunSudoPassword("sshd -T", m.sudoPassword)
+	if err != nil {
+		return nil, fmt.Errorf("error getting effective sshd config: %w [%s]", err, strings.TrimSpace(stderr))
+	}
+
+	wanted := map[string]bool{}
+	for _, keyword := range keywords {
+		wanted[strings.ToLower(keyword)] = true
+	}
+
+	result := []Directive{}
+	for _, directive := range ParseConfig(stdout).Directives() {
+		if wanted[directive.Keyword] {
+			result = append(result, directive)
+		}
+	}
+	return result, nil
+}
+
+func (m *sshdManager) upload(path, content string) error {
+	tmpPath := "/tmp/rpi-provisioner-sshd.conf"
+	err := m.conn.WriteToFile(tmpPath, []byte(content))
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %w", path, err)
+	}
+
+	installCmd := fmt.Sprintf("mkdir -p /etc/ssh/sshd_config.d && install -m 644 -o root -g root %s %s && rm %s", tmpPath, path, tmpPath)
+	_, stderr, err := m.conn.RunSudoPassword(installCmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("error updating %s: %w [%s]", path, err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+func (m *sshdManager) restore(mainContent, path, dropIn string, others map[string]string) {
+	m.upload(ConfigPath, mainContent)
+	if dropIn == "" {
+		m.conn.RunSudoPassword("rm -f "+path, m.sudoPassword)
+	} else {
+		m.upload(path, dropIn)
+	}
+	for otherPath, content := range others {
+		m.upload(otherPath, content)
+	}
+}
@@ -0,0 +1,214 @@
+package sshport
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/fail2ban"
+	"github.com/sralloza/rpi-provisioner/pkg/firewall"
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+	"github.com/sralloza/rpi-provisioner/pkg/sshd"
+	cryptossh "golang.org/x/crypto/ssh"
+)
+
+type SSHPortArgs struct {
+	UseSSHKey bool
+	KeyPath   string
+	User      string
+	Password  string
+	Host      string
+	// Current ssh port
+	Port    int
+	NewPort int
+}
+
+type SSHPortResult struct {
+	// known_hosts addresses added for the new port
+	KnownHosts []string
+}
+
+func NewManager() *sshPortManager {
+	return &sshPortManager{}
+}
+
+type sshPortManager struct {
+	conn ssh.SSHConnection
+	// Password used by sudo in the server, empty for passwordless sudo
+	sudoPassword string
+}
+
+// Change moves sshd to the new port. sshd listens on both ports until a new
+// connection to the new port succeeds, so the access to the server is never
+// lost.
+func (m *sshPortManager) Change(args SSHPortArgs) (SSHPortResult, error) {
+	result := SSHPortResult{}
+	if args.NewPort < 1 || args.NewPort > 65535 {
+		return result, fmt.Errorf("invalid port %d", args.NewPort)
+	}
+	if args.NewPort == args.Port {
+		return result, fmt.Errorf("the new port must be different from the current one (%d)", args.Port)
+	}
+
+	address := fmt.Sprintf("%s:%d", args.Host, args.Port)
+	m.conn = ssh.SSHConnection{
+		Password:  args.Password,
+		UseSSHKey: args.UseSSHKey,
+		KeyPath:   args.KeyPath,
+	}
+
+	info.Title("Connecting to %s", address)
+	err := m.conn.Connect(args.User, address)
+	if err != nil {
+		info.Fail()
+		return result, err
+	}
+	defer m.conn.Close()
+	info.Ok()
+
+	if _, _, err := m.conn.Run("sudo -n true"); err != nil {
+		m.sudoPassword = args.Password
+	}
+
+	firewallManager := firewall.NewManager(m.conn, m.sudoPassword)
+	oldPort := firewall.Port{Number: args.Port, Protocol: "tcp"}
+	newPort := firewall.Port{Number: args.NewPort, Protocol: "tcp"}
+
+	ports, err := sshd.NewManager(m.conn, m.sudoPassword).Ports()
+	if err != nil {
+		return result, err
+	}
+	if err := m.checkSocketActivation(); err != nil {
+		return result, err
+	}
+
+	info.Title("Opening port %d in the firewall", args.NewPort)
+	firewallOpened, err := firewallManager.AllowPort(newPort)
+	if err != nil {
+		info.Fail()
+		return result, err
+	} else if firewallOpened {
+		info.Ok()
+	} else {
+		info.Skipped()
+	}
+
+	// Restores the previous state if the new port can't be used
+	undo := func() {
+		m.setPorts(ports)
+		if firewallOpened {
+			firewallManager.RemovePort(newPort)
+		}
+	}
+
+	info.Title("Adding port %d to sshd", args.NewPort)
+	if err := m.setPorts([]int{args.Port, args.NewPort}); err != nil {
+		info.Fail()
+		undo()
+		return result, err
+	}
+	info.Ok()
+
+	info.Title("Verifying ssh connection on port %d", args.NewPort)
+	err = m.conn.CheckLogin(args.User, fmt.Sprintf("%s:%d", args.Host, args.NewPort))
+	if err != nil {
+		info.Fail()
+		undo()
+		return result, fmt.Errorf("can't connect to port %d, sshd was restored to the previous ports: %w", args.NewPort, err)
+	}
+	info.Ok()
+
+	info.Title("Removing port %d from sshd", args.Port)
+	if err := m.setPorts([]int{args.NewPort}); err != nil {
+		info.Fail()
+		return result, err
+	}
+	// Other settings (like a ListenAddress with a port) could keep the old
+	// port open, so the firewall rule is only removed if it is really closed
+	current, err := sshd.NewManager(m.conn, m.sudoPassword).Ports()
+	if err != nil {
+		info.Fail()
+		return result, err
+	}
+	if !slices.Equal(current, []int{args.NewPort}) {
+		info.Fail()
+		return result, fmt.Errorf("sshd still listens on %v instead of only %d, the firewall was not changed", current, args.NewPort)
+	}
+	info.Ok()
+
+	info.Title("Closing port %d in the firewall", args.Port)
+	if removed, err := firewallManager.RemovePort(oldPort); err != nil {
+		info.Fail()
+		return result, err
+	} else if removed {
+		info.Ok()
+	} else {
+		info.Skipped()
+	}
+
+	info.Title("Updating fail2ban port")
+	if updated, err := fail2ban.NewManager(m.conn, m.sudoPassword).SetPort(args.NewPort); err != nil {
+		info.Fail()
+		return result, err
+	} else if updated {
+		info.Ok()
+	} else {
+		info.Skipped()
+	}
+
+	info.Title("Updating known_hosts")
+	keys, err := m.hostKeys()
+	if err != nil {
+		info.Fail()
+		return result, err
+	}
+	result.KnownHosts, err = ssh.CopyKnownHostsPort(args.Port, args.NewPort, keys, []string{args.Host})
+	if err != nil {
+		info.Fail()
+		return result, err
+	}
+	info.Ok()
+
+	return result, nil
+}
+
+// setPorts writes the ports and reloads sshd. The current connection is
+// kept, as reloading sshd doesn't close the open sessions.
+func (m *sshPortManager) setPorts(ports []int) error {
+	manager := sshd.NewManager(m.conn, m.sudoPassword)
+	if _, err := manager.SetPorts(ports); err != nil {
+		return err
+	}
+	return manager.Reload()
+}
+
+// checkSocketActivation fails if sshd is started by ssh.socket, as the port
+// is set in the socket unit instead of sshd_config
+func (m *sshPortManager) checkSocketActivation() error {
+	if _, _, err := m.conn.Run("systemctl is-active --quiet ssh.socket"); err == nil {
+		return fmt.Errorf("sshd is started by ssh.socket, changing its port is not supported")
+	}
+	return nil
+}
+
+// hostKeys returns the public host keys of the server
+func (m *sshPortManager) hostKeys() ([]cryptossh.PublicKey, error) {
+	stdout, _, err := m.conn.Run("cat /etc/ssh/ssh_host_*_key.pub")
+	if err != nil {
+		return nil, fmt.Errorf("error reading host keys: %w", err)
+	}
+
+	keys := []cryptossh.PublicKey{}
+	for _, line := range strings.Split(stdout, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		key, _, _, _, err := cryptossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing host key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,63 @@
+package state
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+const manifestFile = "manifest.json"
+
+// ManifestEntry is a raspberry prepared with the boot command
+type ManifestEntry struct {
+	Hostname string `json:"hostname"`
+	// Expected MAC address, empty if unknown
+	MAC string `json:"mac,omitempty"`
+	// Static IP configured in the boot partition, empty for DHCP
+	IP        string    `json:"ip,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// ManifestPath returns the default path of the manifest
+func ManifestPath() (string, error) {
+	dir, err := Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, manifestFile), nil
+}
+
+func LoadManifest(path string) ([]ManifestEntry, error) {
+	entries := []ManifestEntry{}
+	err := readJSON(path, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("error reading manifest: %w", err)
+	}
+	return entries, nil
+}
+
+// AddToManifest saves entry in the manifest, replacing the previous entry of
+// the same hostname
+func AddToManifest(path string, entry ManifestEntry) error {
+	entries, err := LoadManifest(path)
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i := range entries {
+		if entries[i].Hostname == entry.Hostname {
+			entries[i] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		entries = append(entries, entry)
+	}
+
+	err = writeJSON(path, entries)
+	if err != nil {
+		return fmt.Errorf("error saving manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const stateFile = "state.json"
+
+// State is the local data that persists between executions
+type State struct {
+	// Last index used by each hostname pattern (e.g. node-%02d)
+	HostnameIndexes map[string]int `json:"hostnameIndexes"`
+}
+
+// Dir returns the directory where the local state is saved
+func Dir() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("error getting config directory: %w", err)
+	}
+	return filepath.Join(configDir, "rpi-provisioner"), nil
+}
+
+func Load() (*State, error) {
+	state := &State{HostnameIndexes: map[string]int{}}
+
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	err = readJSON(filepath.Join(dir, stateFile), state)
+	if err != nil {
+		return nil, fmt.Errorf("error reading state: %w", err)
+	}
+	if state.HostnameIndexes == nil {
+		state.HostnameIndexes = map[string]int{}
+	}
+	return state, nil
+}
+
+func (s *State) Save() error {
+	dir, err := Dir()
+	if err != nil {
+		return err
+	}
+	err = writeJSON(filepath.Join(dir, stateFile), s)
+	if err != nil {
+		return fmt.Errorf("error saving state: %w", err)
+	}
+	return nil
+}
+
+// NextHostname formats pattern with the index following the last one used.
+// If start is positive, it is used as the index instead.
+func (s *State) NextHostname(pattern string, start int) (string, int) {
+	index := start
+	if index <= 0 {
+		index = s.HostnameIndexes[pattern] + 1
+	}
+	return fmt.Sprintf(pattern, index), index
+}
+
+// ValidateHostnamePattern checks that pattern contains exactly one integer verb
+func ValidateHostnamePattern(pattern string) error {
+	formatted := fmt.Sprintf(pattern, 1)
+	if strings.Contains(formatted, "%!") || strings.Count(strings.ReplaceAll(pattern, "%%", ""), "%") != 1 {
+		return fmt.Errorf("invalid hostname pattern '%s', it must contain one integer verb (e.g. node-%%02d)", pattern)
+	}
+	return nil
+}
+
+// readJSON decodes the file into v, a missing file is not an error
+func readJSON(path string, v any) error {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func writeJSON(path string, v any) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
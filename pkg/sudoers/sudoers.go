@@ -0,0 +1,166 @@
+package sudoers
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+)
+
+const (
+	sudoersPath = "/etc/sudoers"
+	dropInDir   = "/etc/sudoers.d"
+)
+
+// Rule is the sudo access of a user
+type Rule struct {
+	User string
+	// Commands the user can run (absolute paths with arguments), empty for all
+	Commands []string
+	// Ask for the password of the user instead of NOPASSWD
+	RequirePassword bool
+}
+
+func (r Rule) Validate() error {
+	if r.User == "" {
+		return fmt.Errorf("sudo rule without user")
+	}
+	for _, command := range r.Commands {
+		if !path.IsAbs(strings.Fields(command + " ")[0]) {
+			return fmt.Errorf("invalid sudo command '%s', it must be an absolute path", command)
+		}
+	}
+	return nil
+}
+
+// Line returns the rule in sudoers format
+func (r Rule) Line() string {
+	commands := "ALL"
+	if len(r.Commands) > 0 {
+		escaped := []string{}
+		for _, command := range r.Commands {
+			escaped = append(escaped, escapeCommand(command))
+		}
+		commands = strings.Join(escaped, ", ")
+	}
+
+	tag := "NOPASSWD: "
+	if r.RequirePassword {
+		tag = ""
+	}
+	return fmt.Sprintf("%s ALL=(ALL) %s%s", r.User, tag, commands)
+}
+
+func (r Rule) render() string {
+	return "# Managed by rpi-provisioner, changes will be overwritten\n" + r.Line() + "\n"
+}
+
+// legacyLine is the rule appended to /etc/sudoers by older versions
+func legacyLine(user string) string {
+	return fmt.Sprintf("%s ALL=(ALL) NOPASSWD: ALL", user)
+}
+
+// DropInPath returns the file of the user in /etc/sudoers.d. sudo skips
+// the files that contain a dot, so they are replaced.
+func DropInPath(user string) string {
+	return path.Join(dropInDir, strings.ReplaceAll(user, ".", "_"))
+}
+
+// escapeCommand escapes the characters with special meaning in sudoers
+func escapeCommand(command string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `,`, `\,`, `:`, `\:`, `=`, `\=`)
+	return replacer.Replace(command)
+}
+
+func NewManager(conn ssh.SSHConnection, sudoPassword string) *sudoersManager {
+	return &sudoersManager{conn: conn, sudoPassword: sudoPassword}
+}
+
+type sudoersManager struct {
+	conn         ssh.SSHConnection
+	sudoPassword string
+}
+
+// Apply writes the rule in the drop-in file of the user and removes the
+// rule appended to /etc/sudoers by older versions. The old rule is only
+// removed once the drop-in is installed, so the user never loses sudo.
+// Returns true if any file changed.
+func (m *sudoersManager) Apply(rule Rule) (bool, error) {
+	if err := rule.Validate(); err != nil {
+		return false, err
+	}
+
+	changed := false
+	dropInPath := DropInPath(rule.User)
+	current, _, err := m.conn.RunSudoPassword("cat "+dropInPath, m.sudoPassword)
+	if err != nil || current != rule.render() {
+		err = m.install(dropInPath, rule.render())
+		if err != nil {
+			return false, err
+		}
+		changed = true
+	}
+
+	migrated, err := m.migrateLegacy(rule.User)
+	if err != nil {
+		return changed, err
+	}
+	return changed || migrated, nil
+}
+
+// Remove deletes the drop-in file of the user
+func (m *sudoersManager) Remove(user string) error {
+	_, stderr, err := m.conn.RunSudoPassword("rm -f "+DropInPath(user), m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("error removing sudoers of %s: %w [%s]", user, err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// migrateLegacy removes the line appended to /etc/sudoers by older versions
+func (m *sudoersManager) migrateLegacy(user string) (bool, error) {
+	line := legacyLine(user)
+	_, _, err := m.conn.RunSudoPassword(fmt.Sprintf("grep -qxF \"%s\" %s", line, sudoersPath), m.sudoPassword)
+	if err != nil {
+		return false, nil
+	}
+
+	content, _, err := m.conn.RunSudoPassword("cat "+sudoersPath, m.sudoPassword)
+	if err != nil {
+		return false, fmt.Errorf("error reading sudoers: %w", err)
+	}
+
+	lines := []string{}
+	for _, current := range strings.Split(strings.TrimRight(content, "\n"), "\n") {
+		if strings.TrimSpace(current) != line {
+			lines = append(lines, current)
+		}
+	}
+	// Remove the blank lines added around the rule
+	newContent := strings.TrimRight(strings.Join(lines, "\n"), "\n") + "\n"
+
+	err = m.install(sudoersPath, newContent)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// install uploads the content to a temporary file and moves it to path
+// (mode 0440) only if visudo accepts it
+func (m *sudoersManager) install(dstPath, content string) error {
+	tmpPath := "/tmp/rpi-provisioner-sudoers"
+	err := m.conn.WriteToFile(tmpPath, []byte(content))
+	if err != nil {
+		return fmt.Errorf("error uploading sudoers: %w", err)
+	}
+
+	installCmd := fmt.Sprintf("visudo -cf %s && mkdir -p %s && install -m 0440 -o root -g root %s %s; status=$?; rm -f %s; exit $status",
+		tmpPath, dropInDir, tmpPath, dstPath, tmpPath)
+	stdout, stderr, err := m.conn.RunSudoPassword(installCmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("invalid sudoers %s: %w [%s]", dstPath, err, strings.TrimSpace(stdout+stderr))
+	}
+	return nil
+}
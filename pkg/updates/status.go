@@ -0,0 +1,115 @@
+package updates
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+)
+
+type StatusArgs struct {
+	UseSSHKey bool
+	KeyPath   string
+	User      string
+	Password  string
+	Hosts     []string
+	Port      int
+	// Update the package lists before checking the pending upgrades
+	Refresh bool
+}
+
+// HostStatus is the update status of a host
+type HostStatus struct {
+	Host string
+	// Packages with a pending upgrade
+	Pending []string
+	// Pending upgrades from a security repository
+	Security       []string
+	RebootRequired bool
+	// Packages that requested the reboot
+	RebootPackages []string
+	// Error connecting or getting the status, the other fields are empty
+	Err error
+}
+
+// Status returns the status of each host. Errors are saved in the status of
+// the host, so one unreachable host doesn't stop the others.
+func Status(args StatusArgs) []HostStatus {
+	result := []HostStatus{}
+	for _, host := range args.Hosts {
+		info.Title("Checking %s", host)
+		status := hostStatus(args, host)
+		if status.Err != nil {
+			info.Fail()
+		} else {
+			info.Ok()
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+func hostStatus(args StatusArgs, host string) HostStatus {
+	status := HostStatus{Host: host}
+	conn := ssh.SSHConnection{
+		Password:  args.Password,
+		UseSSHKey: args.UseSSHKey,
+		KeyPath:   args.KeyPath,
+	}
+	err := conn.Connect(args.User, fmt.Sprintf("%s:%d", host, args.Port))
+	if err != nil {
+		status.Err = err
+		return status
+	}
+	defer conn.Close()
+
+	if args.Refresh {
+		sudoPassword := ""
+		if _, _, err := conn.Run("sudo -n true"); err != nil {
+			sudoPassword = args.Password
+		}
+		_, stderr, err := conn.RunSudoPassword("apt-get update", sudoPassword)
+		if err != nil {
+			status.Err = fmt.Errorf("error updating apt registry: %w [%s]", err, strings.TrimSpace(stderr))
+			return status
+		}
+	}
+
+	// Simulated upgrade, it doesn't need root
+	stdout, _, err := conn.Run("apt-get -s dist-upgrade")
+	if err != nil {
+		status.Err = fmt.Errorf("error getting pending upgrades: %w", err)
+		return status
+	}
+	status.Pending, status.Security = parseSimulation(stdout)
+
+	if _, _, err := conn.Run("test -f /var/run/reboot-required"); err == nil {
+		status.RebootRequired = true
+		stdout, _, _ := conn.Run("cat /var/run/reboot-required.pkgs")
+		status.RebootPackages = strings.Fields(stdout)
+	}
+	return status
+}
+
+// parseSimulation returns the packages upgraded by apt-get -s, and the ones
+// that come from a security repository. Format of the lines:
+//
+//	Inst openssl [3.0.9-1] (3.0.11-1~deb12u1 Debian-Security:12/stable-security [arm64])
+func parseSimulation(output string) ([]string, []string) {
+	pending := []string{}
+	security := []string{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "Inst" {
+			continue
+		}
+		pending = append(pending, fields[1])
+		// Only the origins, the package name may contain "-security"
+		_, origins, _ := strings.Cut(line, "(")
+		if strings.Contains(origins, "-security") || strings.Contains(origins, "Debian-Security") {
+			security = append(security, fields[1])
+		}
+	}
+	return pending, security
+}
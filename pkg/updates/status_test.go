@@ -0,0 +1,69 @@
+package updates
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseSimulation(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		pending  []string
+		security []string
+	}{
+		{
+			name:     "no upgrades",
+			output:   "Reading package lists...\nBuilding dependency tree...\n0 upgraded, 0 newly installed, 0 to remove and 0 not upgraded.\n",
+			pending:  []string{},
+			security: []string{},
+		},
+		{
+			name: "debian bookworm",
+			output: `Reading package lists...
+The following packages will be upgraded:
+  curl openssl
+Inst openssl [3.0.9-1] (3.0.11-1~deb12u1 Debian-Security:12/stable-security [arm64])
+Inst curl [7.88.1-10] (7.88.1-10+deb12u4 Debian:12.4/stable [arm64])
+Conf openssl (3.0.11-1~deb12u1 Debian-Security:12/stable-security [arm64])
+Conf curl (7.88.1-10+deb12u4 Debian:12.4/stable [arm64])
+`,
+			pending:  []string{"openssl", "curl"},
+			security: []string{"openssl"},
+		},
+		{
+			name: "debian with several origins",
+			output: "Inst libssl3 [3.0.9-1] (3.0.11-1~deb12u1 Debian:12.4/stable, Debian-Security:12/stable-security [arm64]) []\n" +
+				"Inst tzdata [2023c-5] (2023c-5+deb12u1 Debian:12.4/stable-updates [all])\n",
+			pending:  []string{"libssl3", "tzdata"},
+			security: []string{"libssl3"},
+		},
+		{
+			name: "raspbian",
+			output: `Inst raspi-config [20231012] (20231108 Raspberry Pi Foundation:stable [all])
+Inst sudo [1.9.13p3-1] (1.9.13p3-1+deb12u1 Raspbian:stable-security [armhf])
+Inst libcamera0.1 [0.1.0+rpt20231122-1] (0.2.0+rpt20240215-1 Raspberry Pi Foundation:stable [armhf])
+`,
+			pending:  []string{"raspi-config", "sudo", "libcamera0.1"},
+			security: []string{"sudo"},
+		},
+		{
+			name:     "security in the package name",
+			output:   "Inst python3-security [1.0-1] (1.1-1 Raspbian:stable [armhf])\n",
+			pending:  []string{"python3-security"},
+			security: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pending, security := parseSimulation(test.output)
+			if !slices.Equal(pending, test.pending) {
+				t.Errorf("expected pending %v, got %v", test.pending, pending)
+			}
+			if !slices.Equal(security, test.security) {
+				t.Errorf("expected security %v, got %v", test.security, security)
+			}
+		})
+	}
+}
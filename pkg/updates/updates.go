@@ -0,0 +1,203 @@
+package updates
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+)
+
+const (
+	// Enables the daily update of the package lists and the upgrades
+	periodicPath = "/etc/apt/apt.conf.d/20auto-upgrades"
+	// Managed settings, read after the defaults of 50unattended-upgrades
+	configPath = "/etc/apt/apt.conf.d/52rpi-provisioner-unattended-upgrades"
+)
+
+// Security updates of Debian and the packages of the Raspberry Pi repository
+// (kernel, firmware...). Raspbian (32 bits) has no security repository.
+var defaultOrigins = []string{
+	"origin=Debian,codename=${distro_codename}-security,label=Debian-Security",
+	"origin=Debian,codename=${distro_codename},label=Debian-Security",
+	"origin=Raspbian,codename=${distro_codename},label=Raspbian",
+	"origin=Raspberry Pi Foundation,codename=${distro_codename},label=Raspberry Pi Foundation",
+}
+
+var mailReports = []string{"always", "only-on-error", "on-change"}
+
+var rebootTimeRegex = regexp.MustCompile(`^([01]\d|2[0-3]):[0-5]\d$|^now$`)
+
+// Config is the configuration of unattended-upgrades
+type Config struct {
+	// Origins-Pattern of the upgraded packages, empty for the default ones
+	Origins []string
+	// Reboot automatically if an upgrade requires it
+	AutomaticReboot bool
+	// Time of the automatic reboot (HH:MM)
+	RebootTime string
+	// Address of the report, empty to disable it
+	Mail string
+	// When the report is sent: always, only-on-error or on-change
+	MailReport string
+}
+
+func DefaultConfig() Config {
+	return Config{
+		AutomaticReboot: true,
+		RebootTime:      "04:00",
+		Mail:            "root",
+		MailReport:      "on-change",
+	}
+}
+
+func MailReports() []string {
+	return mailReports
+}
+
+func (c Config) Validate() error {
+	if c.AutomaticReboot && !rebootTimeRegex.MatchString(c.RebootTime) {
+		return fmt.Errorf("invalid reboot time '%s', it must be HH:MM", c.RebootTime)
+	}
+	valid := false
+	for _, report := range mailReports {
+		valid = valid || c.MailReport == report
+	}
+	if !valid {
+		return fmt.Errorf("invalid mail report '%s' (valid values: %s)", c.MailReport, strings.Join(mailReports, ", "))
+	}
+	for _, origin := range c.Origins {
+		if strings.ContainsAny(origin, "\"'") {
+			return fmt.Errorf("invalid origin '%s', it can't contain quotes", origin)
+		}
+	}
+	return nil
+}
+
+// Render returns the managed apt config. The default origins are cleared,
+// so only the configured ones are upgraded.
+func (c Config) Render() string {
+	origins := c.Origins
+	if len(origins) == 0 {
+		origins = defaultOrigins
+	}
+
+	lines := []string{
+		"// Managed by rpi-provisioner, changes will be overwritten",
+		"#clear Unattended-Upgrade::Origins-Pattern;",
+		"Unattended-Upgrade::Origins-Pattern {",
+	}
+	for _, origin := range origins {
+		lines = append(lines, fmt.Sprintf("\t\"%s\";", origin))
+	}
+	lines = append(lines, "};")
+	lines = append(lines, fmt.Sprintf("Unattended-Upgrade::Automatic-Reboot \"%t\";", c.AutomaticReboot))
+	if c.AutomaticReboot {
+		lines = append(lines, fmt.Sprintf("Unattended-Upgrade::Automatic-Reboot-Time \"%s\";", c.RebootTime))
+	}
+	lines = append(lines, fmt.Sprintf("Unattended-Upgrade::Mail \"%s\";", c.Mail))
+	lines = append(lines, fmt.Sprintf("Unattended-Upgrade::MailReport \"%s\";", c.MailReport))
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func renderPeriodic() string {
+	return strings.Join([]string{
+		"// Managed by rpi-provisioner, changes will be overwritten",
+		"APT::Periodic::Update-Package-Lists \"1\";",
+		"APT::Periodic::Unattended-Upgrade \"1\";",
+		"APT::Periodic::AutocleanInterval \"7\";",
+	}, "\n") + "\n"
+}
+
+func NewManager(conn ssh.SSHConnection, sudoPassword string) *updatesManager {
+	return &updatesManager{conn: conn, sudoPassword: sudoPassword}
+}
+
+type updatesManager struct {
+	conn         ssh.SSHConnection
+	sudoPassword string
+}
+
+func (m *updatesManager) Install() (bool, error) {
+	_, _, err := m.conn.Run("command -v unattended-upgrade")
+	if err == nil {
+		return false, nil
+	}
+	installCmd := "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y unattended-upgrades"
+	if err := m.sudo(installCmd); err != nil {
+		return false, fmt.Errorf("error installing unattended-upgrades: %w", err)
+	}
+	return true, nil
+}
+
+// Configure writes the apt config of unattended-upgrades. The result is
+// checked with apt-config and the previous files are restored if it is
+// invalid.
+func (m *updatesManager) Configure(config Config) (bool, error) {
+	if err := config.Validate(); err != nil {
+		return false, err
+	}
+
+	files := map[string]string{
+		periodicPath: renderPeriodic(),
+		configPath:   config.Render(),
+	}
+	previous := map[string]string{}
+	changed := false
+	for path, content := range files {
+		current, _, err := m.conn.Run("cat " + path)
+		if err != nil {
+			current = ""
+		}
+		previous[path] = current
+		changed = changed || current != content
+	}
+	if !changed {
+		return false, nil
+	}
+
+	for path, content := range files {
+		if err := m.upload(path, content); err != nil {
+			m.restore(previous)
+			return false, err
+		}
+	}
+
+	if err := m.sudo("apt-config dump > /dev/null"); err != nil {
+		m.restore(previous)
+		return false, fmt.Errorf("invalid apt config: %w", err)
+	}
+	return true, nil
+}
+
+func (m *updatesManager) restore(previous map[string]string) {
+	for path, content := range previous {
+		if content == "" {
+			m.sudo("rm -f " + path)
+		} else {
+			m.upload(path, content)
+		}
+	}
+}
+
+func (m *updatesManager) upload(path, content string) error {
+	tmpPath := "/tmp/rpi-provisioner-apt.conf"
+	err := m.conn.WriteToFile(tmpPath, []byte(content))
+	if err != nil {
+		return fmt.Errorf("error uploading %s: %w", path, err)
+	}
+
+	installCmd := fmt.Sprintf("install -m 644 -o root -g root %s %s && rm %s", tmpPath, path, tmpPath)
+	if err := m.sudo(installCmd); err != nil {
+		return fmt.Errorf("error updating %s: %w", path, err)
+	}
+	return nil
+}
+
+func (m *updatesManager) sudo(cmd string) error {
+	_, stderr, err := m.conn.RunSudoPassword(cmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("%w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
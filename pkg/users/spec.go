@@ -0,0 +1,149 @@
+package users
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/sudoers"
+)
+
+const (
+	statePresent = "present"
+	stateAbsent  = "absent"
+)
+
+// The values of the spec end up in shell commands, so they are restricted to
+// characters that don't need quoting (names follow the useradd defaults)
+var (
+	nameRegex  = regexp.MustCompile(`^[a-z_][a-z0-9_.-]{0,31}$`)
+	shellRegex = regexp.MustCompile(`^/[\w./+-]+$`)
+)
+
+// Spec is the file with the users and groups of the server
+type Spec struct {
+	Groups []GroupSpec `json:"groups"`
+	Users  []UserSpec  `json:"users"`
+}
+
+type GroupSpec struct {
+	Name string `json:"name"`
+	// present (default) or absent
+	State string `json:"state"`
+}
+
+type UserSpec struct {
+	Name    string `json:"name"`
+	Comment string `json:"comment"`
+	// Defaults to /bin/bash
+	Shell string `json:"shell"`
+	// Supplementary groups, the user is removed from the groups not listed
+	Groups []string `json:"groups"`
+	// Service account (useradd --system)
+	System bool `json:"system"`
+	// Authorized keys. Can be a AWS S3 URI, HTTP(S) or a file path.
+	KeysUri string `json:"keysUri"`
+	// Sudo access, nil to leave it unmanaged (false in the file removes it)
+	Sudo *SudoSpec `json:"sudo"`
+	// present (default) or absent
+	State string `json:"state"`
+}
+
+type SudoSpec struct {
+	// Commands allowed with sudo, empty for all
+	Commands        []string `json:"commands"`
+	RequirePassword bool     `json:"requirePassword"`
+	// Remove the sudo access (sudo: false)
+	Remove bool `json:"-"`
+}
+
+// UnmarshalJSON accepts false to remove the sudo access, besides the object
+func (s *SudoSpec) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("false")) {
+		s.Remove = true
+		return nil
+	}
+	type sudoSpec SudoSpec
+	return json.Unmarshal(data, (*sudoSpec)(s))
+}
+
+func (u UserSpec) sudoRule() sudoers.Rule {
+	return sudoers.Rule{User: u.Name, Commands: u.Sudo.Commands, RequirePassword: u.Sudo.RequirePassword}
+}
+
+func LoadSpec(path string) (Spec, error) {
+	spec := Spec{}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return spec, fmt.Errorf("error reading users file: %w", err)
+	}
+	err = json.Unmarshal(content, &spec)
+	if err != nil {
+		return spec, fmt.Errorf("error decoding users file: %w", err)
+	}
+	return spec, spec.Validate()
+}
+
+func (s *Spec) Validate() error {
+	for i := range s.Groups {
+		group := &s.Groups[i]
+		if group.Name == "" {
+			return fmt.Errorf("group without name")
+		}
+		if !nameRegex.MatchString(group.Name) {
+			return fmt.Errorf("invalid group name '%s'", group.Name)
+		}
+		if err := normalizeState(&group.State, group.Name); err != nil {
+			return err
+		}
+	}
+
+	for i := range s.Users {
+		user := &s.Users[i]
+		if user.Name == "" {
+			return fmt.Errorf("user without name")
+		}
+		if !nameRegex.MatchString(user.Name) {
+			return fmt.Errorf("invalid user name '%s'", user.Name)
+		}
+		for _, group := range user.Groups {
+			if !nameRegex.MatchString(group) {
+				return fmt.Errorf("invalid group '%s' of %s", group, user.Name)
+			}
+		}
+		// The commands run by sudo are wrapped in single quotes and : is the
+		// separator of /etc/passwd
+		if strings.ContainsAny(user.Comment, "':\n") {
+			return fmt.Errorf("invalid comment of %s, it can't contain ', : or new lines", user.Name)
+		}
+		if err := normalizeState(&user.State, user.Name); err != nil {
+			return err
+		}
+		if user.Shell == "" {
+			user.Shell = "/bin/bash"
+		}
+		if !shellRegex.MatchString(user.Shell) {
+			return fmt.Errorf("invalid shell '%s' of %s, it must be an absolute path", user.Shell, user.Name)
+		}
+		if user.Sudo != nil && !user.Sudo.Remove {
+			if err := user.sudoRule().Validate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func normalizeState(state *string, name string) error {
+	switch *state {
+	case "":
+		*state = statePresent
+	case statePresent, stateAbsent:
+	default:
+		return fmt.Errorf("invalid state '%s' of %s, must be present or absent", *state, name)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package users
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestValidateRejectsUnsafeValues(t *testing.T) {
+	tests := []UserSpec{
+		{Name: "bob;reboot"},
+		{Name: "Bob"},
+		{Name: "bob", Groups: []string{"docker", "$(id)"}},
+		{Name: "bob", Shell: "bash"},
+		{Name: "bob", Shell: "/bin/bash -i"},
+		{Name: "bob", Comment: "Bob's account"},
+		{Name: "bob", Comment: "a:b"},
+	}
+	for _, user := range tests {
+		spec := Spec{Users: []UserSpec{user}}
+		if err := spec.Validate(); err == nil {
+			t.Errorf("Validate accepted %+v", user)
+		}
+	}
+
+	spec := Spec{
+		Groups: []GroupSpec{{Name: "developers"}},
+		Users:  []UserSpec{{Name: "alice.smith", Comment: `Alice "the admin" $(id)`, Groups: []string{"developers"}}},
+	}
+	if err := spec.Validate(); err != nil {
+		t.Errorf("Validate rejected a valid spec: %v", err)
+	}
+}
+
+func TestQuote(t *testing.T) {
+	value := "Alice \"the admin\" $(id) `id` \\ end"
+	stdout, err := exec.Command("bash", "-c", "printf %s "+quote(value)).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stdout) != value {
+		t.Errorf("quote(%q) is parsed as %q", value, stdout)
+	}
+}
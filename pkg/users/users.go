@@ -0,0 +1,294 @@
+package users
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sralloza/rpi-provisioner/pkg/authorizedkeys"
+	"github.com/sralloza/rpi-provisioner/pkg/info"
+	"github.com/sralloza/rpi-provisioner/pkg/ssh"
+	"github.com/sralloza/rpi-provisioner/pkg/sudoers"
+)
+
+type UsersArgs struct {
+	UseSSHKey bool
+	User      string
+	Password  string
+	Host      string
+	Port      int
+	// Deployer user created by layer1, it can't be removed or lose its
+	// sudo access (like the user used to connect)
+	DeployerUser string
+	// Path of the users file
+	File string
+}
+
+func NewManager() *usersManager {
+	return &usersManager{}
+}
+
+type usersManager struct {
+	conn ssh.SSHConnection
+	// Password used by sudo in the server, empty for passwordless sudo
+	sudoPassword string
+}
+
+func (m *usersManager) Apply(args UsersArgs) error {
+	spec, err := LoadSpec(args.File)
+	if err != nil {
+		return err
+	}
+
+	address := fmt.Sprintf("%s:%d", args.Host, args.Port)
+	m.conn = ssh.SSHConnection{
+		Password:  args.Password,
+		UseSSHKey: args.UseSSHKey,
+	}
+
+	info.Title("Connecting to %s", address)
+	err = m.conn.Connect(args.User, address)
+	if err != nil {
+		info.Fail()
+		return err
+	}
+	defer m.conn.Close()
+	info.Ok()
+
+	if _, _, err := m.conn.Run("sudo -n true"); err != nil {
+		m.sudoPassword = args.Password
+	}
+
+	for _, group := range spec.Groups {
+		if group.State == statePresent {
+			err = m.step("Creating group %s", group.Name, func() (bool, error) { return m.ensureGroup(group.Name) })
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, user := range spec.Users {
+		if user.Name == args.User || user.Name == args.DeployerUser {
+			if user.State == stateAbsent {
+				return fmt.Errorf("can't remove %s, it is the user used to connect or the deployer", user.Name)
+			}
+			if user.Sudo != nil && user.Sudo.Remove {
+				return fmt.Errorf("can't remove the sudo access of %s, it is the user used to connect or the deployer", user.Name)
+			}
+		}
+	}
+
+	for _, user := range spec.Users {
+		if user.State == stateAbsent {
+			err = m.step("Removing user %s", user.Name, func() (bool, error) { return m.removeUser(user) })
+		} else {
+			err = m.applyUser(user)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, group := range spec.Groups {
+		if group.State == stateAbsent {
+			err = m.step("Removing group %s", group.Name, func() (bool, error) { return m.removeGroup(group.Name) })
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// step reports the result of a task that returns true if something changed
+func (m *usersManager) step(title, name string, run func() (bool, error)) error {
+	info.Title(title, name)
+	changed, err := run()
+	if err != nil {
+		info.Fail()
+		return err
+	}
+	if changed {
+		info.Ok()
+	} else {
+		info.Skipped()
+	}
+	return nil
+}
+
+func (m *usersManager) applyUser(user UserSpec) error {
+	err := m.step("Creating user %s", user.Name, func() (bool, error) { return m.ensureUser(user) })
+	if err != nil {
+		return err
+	}
+
+	err = m.step("Updating groups of %s", user.Name, func() (bool, error) { return m.updateGroups(user) })
+	if err != nil {
+		return err
+	}
+
+	if user.Sudo != nil {
+		err = m.step("Updating sudo access of %s", user.Name, func() (bool, error) { return m.updateSudo(user) })
+		if err != nil {
+			return err
+		}
+	}
+
+	if user.KeysUri != "" {
+		err = m.step("Provisioning SSH keys of %s", user.Name, func() (bool, error) {
+			group, err := m.primaryGroup(user.Name)
+			if err != nil {
+				return false, err
+			}
+			return authorizedkeys.UploadsshKeys(m.conn, authorizedkeys.UploadsshKeysArgs{
+				User:     user.Name,
+				Password: m.sudoPassword,
+				Group:    group,
+				KeysUri:  user.KeysUri,
+			})
+		})
+	}
+	return err
+}
+
+func (m *usersManager) sudo(cmd string) error {
+	_, stderr, err := m.conn.RunSudoPassword(cmd, m.sudoPassword)
+	if err != nil {
+		return fmt.Errorf("%w [%s]", err, strings.TrimSpace(stderr))
+	}
+	return nil
+}
+
+// quote double quotes value for the shell. It can't contain single quotes, as
+// the commands run by sudo are wrapped in them.
+func quote(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`, "`", "\\`")
+	return `"` + replacer.Replace(value) + `"`
+}
+
+func (m *usersManager) exists(database, name string) bool {
+	_, _, err := m.conn.Run(fmt.Sprintf("getent %s %s", database, name))
+	return err == nil
+}
+
+func (m *usersManager) ensureGroup(name string) (bool, error) {
+	if m.exists("group", name) {
+		return false, nil
+	}
+	if err := m.sudo("groupadd " + name); err != nil {
+		return false, fmt.Errorf("error creating group %s: %w", name, err)
+	}
+	return true, nil
+}
+
+func (m *usersManager) removeGroup(name string) (bool, error) {
+	if !m.exists("group", name) {
+		return false, nil
+	}
+	if err := m.sudo("groupdel " + name); err != nil {
+		return false, fmt.Errorf("error removing group %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// ensureUser creates the user or updates its shell and comment
+func (m *usersManager) ensureUser(user UserSpec) (bool, error) {
+	stdout, _, err := m.conn.Run(fmt.Sprintf("getent passwd %s", user.Name))
+	if err != nil {
+		useraddCmd := fmt.Sprintf("useradd -m -U -s %s -c %s", user.Shell, quote(user.Comment))
+		if user.System {
+			useraddCmd += " --system"
+		}
+		if err := m.sudo(useraddCmd + " " + user.Name); err != nil {
+			return false, fmt.Errorf("error creating user %s: %w", user.Name, err)
+		}
+		return true, nil
+	}
+
+	// name:password:uid:gid:comment:home:shell
+	fields := strings.Split(strings.TrimSpace(stdout), ":")
+	if len(fields) < 7 {
+		return false, fmt.Errorf("error parsing user %s: %s", user.Name, stdout)
+	}
+	if fields[4] == user.Comment && fields[6] == user.Shell {
+		return false, nil
+	}
+
+	usermodCmd := fmt.Sprintf("usermod -s %s -c %s %s", user.Shell, quote(user.Comment), user.Name)
+	if err := m.sudo(usermodCmd); err != nil {
+		return false, fmt.Errorf("error updating user %s: %w", user.Name, err)
+	}
+	return true, nil
+}
+
+func (m *usersManager) primaryGroup(name string) (string, error) {
+	stdout, _, err := m.conn.Run("id -gn " + name)
+	if err != nil {
+		return "", fmt.Errorf("error getting primary group of %s: %w", name, err)
+	}
+	return strings.TrimSpace(stdout), nil
+}
+
+// updateGroups sets the supplementary groups of the user to the listed ones
+func (m *usersManager) updateGroups(user UserSpec) (bool, error) {
+	primary, err := m.primaryGroup(user.Name)
+	if err != nil {
+		return false, err
+	}
+	stdout, _, err := m.conn.Run("id -nG " + user.Name)
+	if err != nil {
+		return false, fmt.Errorf("error getting groups of %s: %w", user.Name, err)
+	}
+
+	current := []string{}
+	for _, group := range strings.Fields(stdout) {
+		if group != primary {
+			current = append(current, group)
+		}
+	}
+	wanted := slices.Clone(user.Groups)
+	sort.Strings(current)
+	sort.Strings(wanted)
+	if slices.Equal(current, wanted) {
+		return false, nil
+	}
+
+	if err := m.sudo(fmt.Sprintf("usermod -G \"%s\" %s", strings.Join(wanted, ","), user.Name)); err != nil {
+		return false, fmt.Errorf("error updating groups of %s: %w", user.Name, err)
+	}
+	return true, nil
+}
+
+// updateSudo applies the sudo access of the user. It isn't changed if the
+// user doesn't have the sudo key.
+func (m *usersManager) updateSudo(user UserSpec) (bool, error) {
+	manager := sudoers.NewManager(m.conn, m.sudoPassword)
+	if !user.Sudo.Remove {
+		return manager.Apply(user.sudoRule())
+	}
+
+	_, _, err := m.conn.RunSudoPassword("test -e "+sudoers.DropInPath(user.Name), m.sudoPassword)
+	if err != nil {
+		return false, nil
+	}
+	return true, manager.Remove(user.Name)
+}
+
+func (m *usersManager) removeUser(user UserSpec) (bool, error) {
+	if !m.exists("passwd", user.Name) {
+		return false, nil
+	}
+
+	// pkill fails if there are no processes
+	m.sudo("pkill -u " + user.Name)
+	if err := m.sudo("userdel -r " + user.Name); err != nil {
+		return false, fmt.Errorf("error removing user %s: %w", user.Name, err)
+	}
+	err := sudoers.NewManager(m.conn, m.sudoPassword).Remove(user.Name)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}